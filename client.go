@@ -3,17 +3,24 @@ package main
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"net"
+	"os"
+	"os/signal"
 	"server_millionclient/public"
 	"server_millionclient/public/protocol"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 )
 
@@ -23,15 +30,47 @@ var (
 	timeout     = flag.Duration("timeout", 10*time.Second, "timeout for connection")
 	goroutines  = flag.Int("goroutines", 1, "number for goroutines")
 	enableTLS   = flag.Bool("tls", false, "enable tls")
+	caFile      = flag.String("ca", "certs/ca.pem", "ca certificate file to verify the server, see gencert")
+	clientCerts = flag.String("client-certs", "", "directory of client certificates for mutual tls, connections use them in turn, empty to disable")
+	sni         = flag.String("sni", "", "tls server name sent in SNI and verified against the server certificate, empty to use the host of -addr")
+	alpn        = flag.String("alpn", "", "comma separated ALPN protocols to offer, e.g. echo or ack, empty to skip ALPN")
+	tlsResume   = flag.Bool("tls-resume", false, "cache tls sessions and resume them when reconnecting")
+	proxyProto  = flag.Int("proxy-protocol", 0, "send a HAProxy PROXY protocol header of this version (1 or 2) on every connection like an L4 load balancer, 0 to disable")
+	proxySrc    = flag.String("proxy-src", "", "client ip claimed in the PROXY header, the port is the real local port, empty to use the real local address")
+	reconnect   = flag.Duration("reconnect-interval", 0, "close and redial each connection after this long, 0 to keep connections")
+
+	heartbeat         = flag.String("heartbeat", "off", "heartbeat mode, same as server: off, client (we ping) or server (server pings, we pong)")
+	heartbeatInterval = flag.Duration("heartbeat-interval", 30*time.Second, "interval between pings in client heartbeat mode")
+	keepalive         = flag.Bool("keepalive", false, "connections only exchange heartbeats, no data messages")
+
+	otlpEndpoint = flag.String("otlp-endpoint", "", "OTLP/HTTP collector url to export traces to, e.g. http://127.0.0.1:4318, empty to disable")
+	traceRatio   = flag.Float64("trace-ratio", 0.01, "fraction of messages to trace, the trace context is sent in the frame header so server spans join the same trace")
 )
 
+var tracer = otel.Tracer("server_millionclient/client")
+
 func main() {
 	flag.Parse()
 	public.InitLogger(true)
 	public.SetLimit()
+	shutdownOTel, err := public.InitOTel(public.OTelConfig{Endpoint: *otlpEndpoint, Service: "client", Ratio: *traceRatio})
+	if err != nil {
+		public.Logger.Fatal("init otel failed", zap.Error(err))
+	}
+	defer shutdownOTel()
+	// 收到信号时正常返回, 以便导出剩余的 span
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	*connections = max(*connections, 1)
 	*goroutines = max(*goroutines, 1)
+	hbMode, err := public.ParseHeartbeatMode(*heartbeat)
+	if err != nil {
+		public.Logger.Fatal("parse heartbeat mode failed", zap.Error(err))
+	}
+	if *keepalive && hbMode == public.HeartbeatOff {
+		public.Logger.Fatal("keepalive requires a heartbeat mode")
+	}
 
 	public.Logger.Info("Connecting to server",
 		zap.String("addr", *addr),
@@ -39,20 +78,73 @@ func main() {
 		zap.Duration("timeout", *timeout),
 		zap.Int("goroutines", *goroutines),
 		zap.Bool("enableTLS", *enableTLS),
+		zap.Stringer("heartbeat", hbMode),
+		zap.Bool("keepalive", *keepalive),
 	)
 
+	var tlsConfs []*tls.Config
+	if *enableTLS {
+		certPool, err := public.LoadCertPool(*caFile)
+		if err != nil {
+			public.Logger.Fatal("load ca failed", zap.Error(err))
+		}
+		// 手动握手以便计时, ServerName 需要自己填
+		host, _, err := net.SplitHostPort(*addr)
+		if err != nil {
+			public.Logger.Fatal("parse addr failed", zap.Error(err))
+		}
+		if *sni != "" {
+			host = *sni
+		}
+		tlsConf := &tls.Config{RootCAs: certPool, ServerName: host}
+		if *alpn != "" {
+			tlsConf.NextProtos = strings.Split(*alpn, ",")
+		}
+		tlsConfs = []*tls.Config{tlsConf}
+		if *clientCerts != "" {
+			certs, err := public.LoadClientCerts(*clientCerts)
+			if err != nil {
+				public.Logger.Fatal("load client certificates failed", zap.Error(err))
+			}
+			// 每个证书一份配置, 连接轮流使用, 模拟多个不同身份的客户端
+			tlsConfs = tlsConfs[:0]
+			for _, cert := range certs {
+				conf := tlsConf.Clone()
+				conf.Certificates = []tls.Certificate{cert}
+				tlsConfs = append(tlsConfs, conf)
+			}
+			public.Logger.Info("loaded client certificates", zap.Int("cnt", len(certs)))
+		}
+		if *tlsResume {
+			// 会话缓存按配置区分, 避免用其他客户端证书建立的会话恢复出错误的身份
+			for _, conf := range tlsConfs {
+				conf.ClientSessionCache = tls.NewLRUClientSessionCache(*connections/len(tlsConfs) + 1)
+			}
+		}
+	}
+	if *proxyProto != 0 && *proxyProto != 1 && *proxyProto != 2 {
+		public.Logger.Fatal("unknown proxy protocol version", zap.Int("version", *proxyProto))
+	}
+	var srcIP net.IP
+	if *proxySrc != "" {
+		if srcIP = net.ParseIP(*proxySrc); srcIP == nil {
+			public.Logger.Fatal("parse proxy src failed", zap.String("ip", *proxySrc))
+		}
+	}
+	dial := func(ctx context.Context, i int) (net.Conn, *handshakeStat, error) {
+		dialer := &proxyDialer{Dialer: net.Dialer{Timeout: *timeout}, version: *proxyProto, srcIP: srcIP}
+		if *enableTLS {
+			return tlsDial(ctx, dialer, tlsConfs[i%len(tlsConfs)], "tcp", *addr)
+		}
+		conn, err := dialer.DialContext(ctx, "tcp", *addr)
+		return conn, nil, err
+	}
+
 	// 1. init conns
 	conns := make([]net.Conn, *connections)
-	err := parallelProcess(conns, min(10, *goroutines), func(ctx context.Context, start, end int, conns []net.Conn) error {
+	err = parallelProcess(ctx, conns, min(10, *goroutines), func(ctx context.Context, start, end int, conns []net.Conn) error {
 		for i := start; i < end; i++ {
-			dialer := &net.Dialer{Timeout: *timeout}
-			var conn net.Conn
-			var err error
-			if *enableTLS {
-				conn, err = tlsDial(ctx, dialer, "tcp", *addr)
-			} else {
-				conn, err = dialer.DialContext(ctx, "tcp", *addr)
-			}
+			conn, _, err := dial(ctx, i)
 			if err != nil {
 				if errors.Is(err, context.Canceled) {
 					return nil
@@ -64,7 +156,7 @@ func main() {
 		}
 		return nil
 	})
-	if err != nil {
+	if err != nil || ctx.Err() != nil {
 		return
 	}
 	if len(conns) == 0 {
@@ -72,9 +164,17 @@ func main() {
 	} else {
 		public.Logger.Info("Finished initializing connections", zap.Int("cnt", len(conns)))
 	}
+	if tlsConn, ok := conns[0].(*tls.Conn); ok {
+		state := tlsConn.ConnectionState()
+		public.Logger.Info("tls negotiated", zap.String("serverName", state.ServerName),
+			zap.String("protocol", state.NegotiatedProtocol), zap.String("subject", state.PeerCertificates[0].Subject.CommonName))
+	}
 	defer func() {
+		// 重连失败的连接已经关闭, 位置为 nil
 		for _, conn := range conns {
-			conn.Close()
+			if conn != nil {
+				conn.Close()
+			}
 		}
 	}()
 
@@ -83,52 +183,120 @@ func main() {
 	if *connections > 100 {
 		tts = time.Millisecond * 5
 	}
-	_ = parallelProcess(conns, *goroutines, func(ctx context.Context, start, end int, conns []net.Conn) error {
+	lastPing := make([]time.Time, len(conns))
+	connectedAt := make([]time.Time, len(conns))
+	for i := range connectedAt {
+		connectedAt[i] = time.Now()
+	}
+	_ = parallelProcess(ctx, conns, *goroutines, func(ctx context.Context, start, end int, conns []net.Conn) error {
 		timer := time.NewTimer(tts)
 
 		for {
-			var diffArr []int64
+			var msgRttArr, rttArr, fullArr, resumedArr []int64
 			for i := start; i < end; i++ {
-				conn := conns[i]
-				if conn == nil {
+				if conns[i] == nil {
 					continue
 				}
+				if *reconnect > 0 && time.Since(connectedAt[i]) >= *reconnect {
+					_ = conns[i].Close()
+					conn, stat, err := dial(ctx, i)
+					if err != nil {
+						conns[i] = nil
+						if errors.Is(err, context.Canceled) {
+							return nil
+						}
+						public.Logger.Error("reconnect failed", zap.Int("idx", i), zap.Error(err))
+						return err
+					}
+					conns[i], connectedAt[i] = conn, time.Now()
+					if stat != nil && stat.resumed {
+						resumedArr = append(resumedArr, stat.duration.Microseconds())
+					} else if stat != nil {
+						fullArr = append(fullArr, stat.duration.Microseconds())
+					}
+				}
+				conn := conns[i]
 
-				timer.Reset(tts)
-				select {
-				case <-ctx.Done():
-					return nil
-				case <-timer.C:
+				// 只等服务端 ping 时由 readFrame 阻塞, 无需额外限速
+				if !*keepalive || hbMode != public.HeartbeatServer {
+					timer.Reset(tts)
+					select {
+					case <-ctx.Done():
+						return nil
+					case <-timer.C:
+					}
 				}
-				ts := time.Now().UnixMilli()
-				bytes, err := buildMsg(i, ts)
-				if err != nil {
-					public.Logger.Error("genMsg failed", zap.Int("idx", i), zap.Error(err))
-					return err
+
+				if hbMode == public.HeartbeatClient && time.Since(lastPing[i]) >= *heartbeatInterval {
+					rtt, err := ping(conn)
+					if err != nil {
+						public.Logger.Error("ping failed", zap.Int("idx", i), zap.Error(err))
+						return err
+					}
+					lastPing[i] = time.Now()
+					rttArr = append(rttArr, rtt.Microseconds())
 				}
-				if _, err = conn.Write(bytes); err != nil {
-					public.Logger.Error("conn.Write failed", zap.Int("idx", i), zap.Error(err))
-					return err
+				if *keepalive {
+					// server 模式下只需等待服务端的 ping 并回复
+					if hbMode == public.HeartbeatServer {
+						if _, err := readFrame(conn, protocol.TypePing); err != nil {
+							public.Logger.Error("wait ping failed", zap.Int("idx", i), zap.Error(err))
+							return err
+						}
+					}
+					continue
 				}
-				if reply, err := readMsg(conn); err != nil {
-					public.Logger.Error("readMsg failed", zap.Int("idx", i), zap.Error(err))
+
+				reply, err := sendMsg(ctx, conn, i)
+				if err != nil {
+					public.Logger.Error("sendMsg failed", zap.Int("idx", i), zap.Error(err))
 					return err
-				} else {
-					diffArr = append(diffArr, time.Now().UnixMilli()-reply.Ts)
 				}
+				// 发送时间由服务端原样回传, 与当前时间出自同一个时钟, 不受两端时钟偏差影响
+				msgRttArr = append(msgRttArr, time.Since(time.Unix(0, reply.Ts)).Microseconds())
 			}
-			public.Logger.Info("Finished sending messages", zap.Int("cnt", len(diffArr)), zap.Int64("diffAvg", avg(diffArr)))
+			public.Logger.Info("Finished sending messages", zap.Int("cnt", len(msgRttArr)),
+				zap.Int64("msgRttAvgUs", avg(msgRttArr)), zap.Int64("msgRttMaxUs", maxOf(msgRttArr)),
+				zap.Int("pings", len(rttArr)), zap.Int64("rttAvgUs", avg(rttArr)),
+				zap.Int("fullHandshakes", len(fullArr)), zap.Int64("fullAvgUs", avg(fullArr)),
+				zap.Int("resumedHandshakes", len(resumedArr)), zap.Int64("resumedAvgUs", avg(resumedArr)))
 		}
 	})
 }
 
-func buildMsg(i int, ts int64) ([]byte, error) {
-	msg := public.Msg{Id: i, Ts: ts}
+// sendMsg 发送一条消息并等待回复. 被采样的消息在帧头扩展中携带 trace context, 服务端的 span 作为它的子 span
+func sendMsg(ctx context.Context, conn net.Conn, i int) (public.Msg, error) {
+	_, span := tracer.Start(ctx, "message", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.Int("conn.idx", i)))
+	defer span.End()
+	bytes, err := buildMsg(i, time.Now(), public.TraceContextOf(span))
+	if err != nil {
+		return public.Msg{}, fmt.Errorf("genMsg failed: %w", err)
+	}
+	if _, err = conn.Write(bytes); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return public.Msg{}, fmt.Errorf("conn.Write failed: %w", err)
+	}
+	reply, err := readMsg(conn)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return public.Msg{}, fmt.Errorf("readMsg failed: %w", err)
+	}
+	return reply, nil
+}
+
+// buildMsg tc 不为 nil 时在帧头扩展中携带 trace context
+func buildMsg(i int, now time.Time, tc *protocol.TraceContext) ([]byte, error) {
+	msg := public.Msg{Id: i, Ts: now.UnixNano()}
 	body, err := json.Marshal(msg)
 	if err != nil {
 		return nil, fmt.Errorf("json.Marshal failed: %w", err)
 	}
-	bytes, err := protocol.Pack(body)
+	var bytes []byte
+	if tc != nil {
+		bytes, err = protocol.PackTraced(body, *tc)
+	} else {
+		bytes, err = protocol.Pack(body)
+	}
 	if err != nil {
 		return nil, fmt.Errorf("protocol.Pack failed: %w", err)
 	}
@@ -137,9 +305,9 @@ func buildMsg(i int, ts int64) ([]byte, error) {
 
 func readMsg(conn net.Conn) (public.Msg, error) {
 	var msg public.Msg
-	_, body, err := protocol.Read(conn)
+	body, err := readFrame(conn, protocol.TypeData)
 	if err != nil {
-		return msg, fmt.Errorf("protocol.Read failed: %w", err)
+		return msg, err
 	}
 	if err = json.Unmarshal(body, &msg); err != nil {
 		return msg, fmt.Errorf("json.Unmarshal failed: %w", err)
@@ -147,12 +315,55 @@ func readMsg(conn net.Conn) (public.Msg, error) {
 	return msg, nil
 }
 
-func parallelProcess[T any](s []T, goroutines int, do func(context.Context, int, int, []T) error) error {
+// readFrame 读取下一个 typ 类型的帧, 期间收到的服务端 ping 自动回复 pong, 其他帧丢弃
+func readFrame(conn net.Conn, typ protocol.FrameType) ([]byte, error) {
+	for {
+		header, body, err := protocol.Read(conn)
+		if err != nil {
+			return nil, fmt.Errorf("protocol.Read failed: %w", err)
+		}
+		if header.Type == protocol.TypePing {
+			pong, err := protocol.PackFrame(protocol.TypePong, body)
+			if err != nil {
+				return nil, fmt.Errorf("protocol.PackFrame failed: %w", err)
+			}
+			if _, err = conn.Write(pong); err != nil {
+				return nil, fmt.Errorf("write pong failed: %w", err)
+			}
+		}
+		if header.Type == typ {
+			return body, nil
+		}
+	}
+}
+
+// ping 发送 ping 并等待 pong, 返回 RTT
+func ping(conn net.Conn) (time.Duration, error) {
+	frame, err := protocol.PackPing(time.Now())
+	if err != nil {
+		return 0, fmt.Errorf("protocol.PackPing failed: %w", err)
+	}
+	if _, err = conn.Write(frame); err != nil {
+		return 0, fmt.Errorf("write ping failed: %w", err)
+	}
+	body, err := readFrame(conn, protocol.TypePong)
+	if err != nil {
+		return 0, err
+	}
+	sent, ok := protocol.PingTime(body)
+	if !ok {
+		return 0, fmt.Errorf("illegal pong body: %x", body)
+	}
+	return time.Since(sent), nil
+}
+
+func parallelProcess[T any](parent context.Context, s []T, goroutines int, do func(context.Context, int, int, []T) error) error {
 	slen := len(s)
 	goroutines = min(goroutines, slen)
 	psize, remainder := max(1, slen/goroutines), slen%goroutines
 
-	ctx, cancel := context.WithCancelCause(context.Background())
+	ctx, cancel := context.WithCancelCause(parent)
+	defer cancel(nil)
 	var errOnce sync.Once
 	var wg sync.WaitGroup
 	var start, end int
@@ -180,6 +391,9 @@ func parallelProcess[T any](s []T, goroutines int, do func(context.Context, int,
 }
 
 func avg(arr []int64) int64 {
+	if len(arr) == 0 {
+		return 0
+	}
 	var sum int64
 	for _, v := range arr {
 		sum += v
@@ -187,38 +401,63 @@ func avg(arr []int64) int64 {
 	return sum / int64(len(arr))
 }
 
-func tlsDial(ctx context.Context, netDialer *net.Dialer, network, addr string) (net.Conn, error) {
-	certPool := x509.NewCertPool()
-	certPool.AppendCertsFromPEM(certBytes)
-
-	conf := &tls.Config{
-		RootCAs: certPool,
+func maxOf(arr []int64) int64 {
+	var m int64
+	for _, v := range arr {
+		m = max(m, v)
 	}
+	return m
+}
 
-	dialer := tls.Dialer{
-		NetDialer: netDialer,
-		Config:    conf,
+// handshakeStat 客户端一次 tls 握手的耗时以及是否恢复了会话
+type handshakeStat struct {
+	duration time.Duration
+	resumed  bool
+}
+
+func tlsDial(ctx context.Context, netDialer *proxyDialer, conf *tls.Config, network, addr string) (net.Conn, *handshakeStat, error) {
+	rawConn, err := netDialer.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, nil, err
 	}
-	return dialer.DialContext(ctx, network, addr)
+	if netDialer.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, netDialer.Timeout)
+		defer cancel()
+	}
+	conn := tls.Client(rawConn, conf)
+	start := time.Now()
+	if err = conn.HandshakeContext(ctx); err != nil {
+		_ = rawConn.Close()
+		return nil, nil, err
+	}
+	return conn, &handshakeStat{duration: time.Since(start), resumed: conn.ConnectionState().DidResume}, nil
 }
 
-// go run $(go env GOROOT)/src/crypto/tls/generate_cert.go --host 1m-server,127.0.0.1,10.89.3.10
-var certBytes = []byte(`-----BEGIN CERTIFICATE-----
-MIIDBTCCAe2gAwIBAgIQQB8UAlRvHS6L3dGaeEKagzANBgkqhkiG9w0BAQsFADAS
-MRAwDgYDVQQKEwdBY21lIENvMB4XDTI1MDIxMjE0MTQxN1oXDTI2MDIxMjE0MTQx
-N1owEjEQMA4GA1UEChMHQWNtZSBDbzCCASIwDQYJKoZIhvcNAQEBBQADggEPADCC
-AQoCggEBAKrAH2tUoKCJuLt6PT+83NS0xa/6xCAqCeSMtUfRYCh5RrE+Ee9sWbNp
-bis9QUsXTzAvXCk0X1ajsO2PKU4MFqVLN1Ks9A3yQFFPPXlNzqgFlURI7NzSR/ad
-OSGH6Txic+ehjccM9A+LMlI2KdU9+PNAPKEoEH/i3n+HlaO6sOl4kMS3nB2nlrSk
-dtPZab8UfI6YnSzOqL+d9/fOUMVdbmvKk8bGXRi7X1B3jUc5ehT9O9uBipn3MLUr
-EN3fBCJu+JmH2cCn1Skjw1L9uQqpoUslyIyKcYG64hxPNYb6Q2ZQi41hzlCC88d1
-TcaEBS+K84uzRSDAbQSkhTGFF5Ahd4cCAwEAAaNXMFUwDgYDVR0PAQH/BAQDAgWg
-MBMGA1UdJQQMMAoGCCsGAQUFBwMBMAwGA1UdEwEB/wQCMAAwIAYDVR0RBBkwF4IJ
-MW0tc2VydmVyhwR/AAABhwQKWQMKMA0GCSqGSIb3DQEBCwUAA4IBAQAehnUHAZ8/
-5pGMK6Afo8E4HmBIxUv8dJnji/B3d2JXYqcGSnTmOpA48Bk+zFDe4lYNk4vxb9Sr
-DbPm7hzsYodIfRUlV7wtGCvKuo6uyHJmI2t0xZcd3Gw9Du2CvwP2zRfFDdQ9EYZO
-KsTw6dz/OEwEj+aCxhpbks3IjnQc4bmu1a43pOCg3UIZdhqdDhS0xP+bdLvhOzFc
-6AniPj5kTo3QTQDn2cDKF1xXiTEA8rWCZPEeL75bD79FH1en3giZm+GedgRAqPKN
-IXhuCjACrVUDHkt8kOVXp6aP6z0A6+9XAEvmiJZxG7rLLwy5XNmBFnJuC5MzUqo4
-HNV5j5L+pyx6
------END CERTIFICATE-----`)
+// proxyDialer 建立连接后先发送 PROXY 头, 模拟服务端前面的 L4 负载均衡器. version 为 0 时与 net.Dialer 相同
+type proxyDialer struct {
+	net.Dialer
+	version int
+	// srcIP PROXY 头中声明的客户端 ip, nil 时使用真实的本地地址
+	srcIP net.IP
+}
+
+func (d *proxyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, addr)
+	if err != nil || d.version == 0 {
+		return conn, err
+	}
+	src, dst := *conn.LocalAddr().(*net.TCPAddr), conn.RemoteAddr().(*net.TCPAddr)
+	if d.srcIP != nil {
+		src.IP = d.srcIP
+	}
+	header, err := public.AppendProxyHeader(nil, d.version, &src, dst)
+	if err == nil {
+		_, err = conn.Write(header)
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("write proxy header failed: %w", err)
+	}
+	return conn, nil
+}
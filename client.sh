@@ -22,6 +22,7 @@ for (( c=0; c<REPLICAS; c++ )); do
         --ulimit nofile=655350:655350 \
         --network 1m-tcpserver \
         -v "$(pwd)/build/client:/client" \
+        -v "$(pwd)/certs:/certs:ro" \
         --name 1m-client-$c \
         -d alpine \
         /client -addr="$ADDR" -conn="$CONNECTIONS" -timeout=10m -goroutines="$GOROUTINES" -tls="$TLS"
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"server_millionclient/public"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 为测试网络生成一次性的 CA, 服务端证书以及(可选的)客户端证书:
+// go run ./gencert -out certs -hosts 1m-server,127.0.0.1,10.89.3.10 -clients 100 -tenants a.example.com,*.b.example.com
+var (
+	out      = flag.String("out", "certs", "output directory")
+	hosts    = flag.String("hosts", "1m-server,localhost,127.0.0.1,10.89.3.10", "comma separated DNS names and IPs of the server certificate")
+	validFor = flag.Duration("valid-for", 30*24*time.Hour, "certificate validity")
+	tenants  = flag.String("tenants", "", "comma separated tenant host names, each gets a server certificate in <out>/tenants for SNI, see -cert-dir")
+	clients  = flag.Int("clients", 0, "number of client certificates to generate into <out>/clients for mTLS")
+)
+
+func main() {
+	flag.Parse()
+	public.InitLogger(false)
+
+	if err := os.MkdirAll(*out, 0o755); err != nil {
+		public.Logger.Fatal("create output directory failed", zap.Error(err))
+	}
+
+	ca, err := public.GenerateCA(*validFor)
+	if err != nil {
+		public.Logger.Fatal("generate ca failed", zap.Error(err))
+	}
+	server, err := public.GenerateServerCert(ca, strings.Split(*hosts, ","), *validFor)
+	if err != nil {
+		public.Logger.Fatal("generate server certificate failed", zap.Error(err))
+	}
+
+	write("ca.pem", ca.CertPEM, 0o644)
+	write("ca-key.pem", ca.KeyPEM, 0o600)
+	write("server.pem", server.CertPEM, 0o644)
+	write("server-key.pem", server.KeyPEM, 0o600)
+
+	var tenantHosts []string
+	if *tenants != "" {
+		tenantHosts = strings.Split(*tenants, ",")
+		if err := os.MkdirAll(filepath.Join(*out, "tenants"), 0o755); err != nil {
+			public.Logger.Fatal("create tenants directory failed", zap.Error(err))
+		}
+	}
+	for _, host := range tenantHosts {
+		tenant, err := public.GenerateServerCert(ca, []string{host}, *validFor)
+		if err != nil {
+			public.Logger.Fatal("generate tenant certificate failed", zap.String("host", host), zap.Error(err))
+		}
+		// 通配符证书的文件名去掉 "*.", 即租户名
+		name := strings.TrimPrefix(host, "*.")
+		write(filepath.Join("tenants", name+".pem"), tenant.CertPEM, 0o644)
+		write(filepath.Join("tenants", name+"-key.pem"), tenant.KeyPEM, 0o600)
+	}
+
+	if *clients > 0 {
+		if err := os.MkdirAll(filepath.Join(*out, "clients"), 0o755); err != nil {
+			public.Logger.Fatal("create clients directory failed", zap.Error(err))
+		}
+	}
+	for i := range *clients {
+		name := fmt.Sprintf("client-%d", i)
+		client, err := public.GenerateClientCert(ca, name, *validFor)
+		if err != nil {
+			public.Logger.Fatal("generate client certificate failed", zap.Error(err))
+		}
+		write(filepath.Join("clients", name+".pem"), client.CertPEM, 0o644)
+		write(filepath.Join("clients", name+"-key.pem"), client.KeyPEM, 0o600)
+	}
+	public.Logger.Info("certificates generated", zap.String("out", *out), zap.String("hosts", *hosts),
+		zap.Int("tenants", len(tenantHosts)), zap.Int("clients", *clients), zap.Time("notAfter", server.Cert.NotAfter))
+}
+
+func write(name string, data []byte, perm os.FileMode) {
+	if err := os.WriteFile(filepath.Join(*out, name), data, perm); err != nil {
+		public.Logger.Fatal("write file failed", zap.String("name", name), zap.Error(err))
+	}
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"fmt"
+	"server_millionclient/public"
+	"slices"
+	"strings"
+)
+
+const (
+	gridWidth   = 24
+	panelWidth  = 8
+	panelHeight = 8
+)
+
+// selector 所有查询共用的筛选条件, 带 poller 标签的指标还按 $poller 筛选
+const (
+	selector       = `backend=~"^($backend)$",instance=~"^($instance)$"`
+	pollerSelector = `,poller=~"^($poller)$"`
+)
+
+// overviewMetrics 第一行按 backend 对比的指标, 每 3 个一行, 不存在的指标跳过.
+// tcp 的面板在 latency_seconds 正下方, 延迟升高时对照是否是网络问题
+var overviewMetrics = []string{
+	"connections", "ops", "latency_seconds",
+	"heartbeat_rtt_seconds", "tcp_retransmits", "tcp_rtt_seconds",
+	"bytes_in", "bytes_out", "connection_closes",
+}
+
+// runtimeMetrics Go runtime 与进程指标的一部分, 由 collectors 注册, 不在 public.MetricDefs 中
+var runtimeMetrics = []public.MetricDef{
+	{Name: "go_goroutines", Help: "Number of goroutines that currently exist", Type: public.MetricGauge},
+	{Name: "go_memstats_heap_inuse_bytes", Help: "Number of heap bytes that are in use", Type: public.MetricGauge},
+	{Name: "go_memstats_alloc_bytes_total", Help: "Total number of bytes allocated in heap until now, even if released already", Type: public.MetricCounter},
+	{Name: "go_gc_duration_seconds", Help: "A summary of the wall-time pause (stop-the-world) duration in garbage collection cycles", Type: public.MetricGauge, Labels: []string{"quantile"}},
+	{Name: "process_resident_memory_bytes", Help: "Resident memory size in bytes", Type: public.MetricGauge},
+	{Name: "process_cpu_seconds_total", Help: "Total user and system CPU time spent in seconds, shown as the number of busy cores", Type: public.MetricCounter},
+	{Name: "process_open_fds", Help: "Number of open file descriptors", Type: public.MetricGauge},
+}
+
+// derivedPanel 由多个指标计算出的面板, 表达式中的 %[1]s 为 selector, %[2]s 为带 poller 的 selector.
+// requires 中的指标都存在时才生成
+type derivedPanel struct {
+	title       string
+	description string
+	unit        string
+	requires    []string
+	exprs       []string
+	legends     []string
+}
+
+var derivedPanels = []derivedPanel{
+	{
+		title:       "poller skew (max / avg)",
+		description: "Max over average of each poller on the same instance, 1 means SO_REUSEPORT spreads connections evenly",
+		unit:        "short",
+		requires:    []string{"poller_registered_fds", "poller_events"},
+		exprs: []string{
+			`max by (instance) (poller_registered_fds{%[1]s}) / avg by (instance) (poller_registered_fds{%[1]s})`,
+			`max by (instance) (rate(poller_events{%[1]s}[$__rate_interval])) / avg by (instance) (rate(poller_events{%[1]s}[$__rate_interval]))`,
+		},
+		legends: []string{"fds {{instance}}", "events {{instance}}"},
+	},
+	{
+		title:       "poller events per wait",
+		description: "Average number of events returned by one EpollWait, epoll backends only",
+		unit:        "short",
+		requires:    []string{"poller_events", "poller_wait_iterations"},
+		exprs: []string{
+			`sum by (instance, poller) (rate(poller_events{%[2]s}[$__rate_interval])) / sum by (instance, poller) (rate(poller_wait_iterations{%[2]s}[$__rate_interval]))`,
+		},
+		legends: []string{"{{instance}} {{poller}}"},
+	},
+	{
+		title:       "tcp connections with retransmits",
+		description: "Fraction of sampled connections that retransmitted at least once",
+		unit:        "percentunit",
+		requires:    []string{"tcp_retransmits"},
+		exprs: []string{
+			`1 - sum(rate(tcp_retransmits_bucket{%[1]s,le=~"0(\\.0)?"}[$__rate_interval])) / sum(rate(tcp_retransmits_count{%[1]s}[$__rate_interval]))`,
+		},
+		legends: []string{"with retransmits"},
+	},
+}
+
+// newDashboard 第一行按 backend 对比主要指标; 之后每个 backend 一行(按 $backend 重复),
+// 依次是 defs 中每个指标一个面板, 派生面板, 以及 Go runtime 与进程指标
+func newDashboard(defs []public.MetricDef) *dashboard {
+	byName := make(map[string]public.MetricDef, len(defs))
+	for _, def := range defs {
+		byName[def.Name] = def
+	}
+
+	var l layout
+	l.row("overview", "")
+	for _, name := range overviewMetrics {
+		if def, ok := byName[name]; ok {
+			l.add(metricPanel(def, true))
+		}
+	}
+
+	l.row("$backend", "backend")
+	for _, def := range defs {
+		l.add(metricPanel(def, false))
+	}
+	for _, d := range derivedPanels {
+		if !slices.ContainsFunc(d.requires, func(name string) bool { _, ok := byName[name]; return !ok }) {
+			l.add(d.panel())
+		}
+	}
+	for _, def := range runtimeMetrics {
+		l.add(metricPanel(def, false))
+	}
+
+	return &dashboard{
+		Inputs: []input{{
+			Name:       "DS_PROMETHEUS",
+			Label:      "prometheus",
+			Type:       "datasource",
+			PluginID:   "prometheus",
+			PluginName: "Prometheus",
+		}},
+		Elements: map[string]any{},
+		Requires: []require{
+			{Type: "grafana", ID: "grafana", Name: "Grafana", Version: "11.5.1"},
+			{Type: "datasource", ID: "prometheus", Name: "Prometheus", Version: "1.0.0"},
+			{Type: "panel", ID: "timeseries", Name: "Time series"},
+		},
+		Annotations: annotations{List: []annotation{{
+			BuiltIn:    1,
+			Datasource: datasource{Type: "datasource", UID: "grafana"},
+			Enable:     true,
+			Hide:       true,
+			IconColor:  "rgba(0, 211, 255, 1)",
+			Name:       "Annotations & Alerts",
+			Type:       "dashboard",
+		}}},
+		Editable: true,
+		// 共享十字线, 对照同一时刻的延迟与 tcp, poller 面板
+		GraphTooltip:  1,
+		Links:         []any{},
+		Panels:        l.panels,
+		Refresh:       "30s",
+		SchemaVersion: 40,
+		Tags:          []string{},
+		Templating: templating{List: []variable{
+			queryVariable("backend", "label_values(connections, backend)"),
+			queryVariable("instance", `label_values(connections{backend=~"^($backend)$"}, instance)`),
+			queryVariable("poller", fmt.Sprintf("label_values(poller_registered_fds{%s}, poller)", selector)),
+		}},
+		Time:       timeRange{From: "now-30m", To: "now"},
+		Timepicker: map[string]any{},
+		Timezone:   "browser",
+		Title:      "1m-tcp-server",
+		UID:        "1pFZFgvmz",
+		Version:    1,
+	}
+}
+
+// metricPanel 一个指标的面板. overview 时按 backend 聚合, 否则在 backend 之内按标签聚合:
+// counter 为速率, gauge 为当前值(按 instance 区分), histogram 为分位数. 带 poller 标签的指标按 instance 和 poller 区分
+func metricPanel(def public.MetricDef, overview bool) panel {
+	sel := selector
+	var by []string
+	switch {
+	case overview:
+		by = append(by, "backend")
+	case def.Type == public.MetricGauge || slices.Contains(def.Labels, "poller"):
+		by = append(by, "instance")
+	}
+	for _, label := range def.Labels {
+		if label == "poller" {
+			if overview {
+				continue
+			}
+			sel += pollerSelector
+		}
+		by = append(by, label)
+	}
+
+	p := newPanel(def.Name, def.Help, metricUnit(def))
+	switch def.Type {
+	case public.MetricCounter:
+		p.addTarget(sum(by, fmt.Sprintf("rate(%s{%s}[$__rate_interval])", def.Name, sel)), legend("", by, def.Name))
+	case public.MetricGauge:
+		p.addTarget(sum(by, fmt.Sprintf("%s{%s}", def.Name, sel)), legend("", by, def.Name))
+	case public.MetricHistogram:
+		quantiles := []struct{ q, name string }{{"0.5", "p50"}, {"0.99", "p99"}}
+		if overview {
+			quantiles = quantiles[1:]
+		}
+		expr := sum(append([]string{"le"}, by...), fmt.Sprintf("rate(%s_bucket{%s}[$__rate_interval])", def.Name, sel))
+		for _, q := range quantiles {
+			p.addTarget(fmt.Sprintf("histogram_quantile(%s, %s)", q.q, expr), legend(q.name, by, ""))
+		}
+	}
+	return p
+}
+
+func (d derivedPanel) panel() panel {
+	p := newPanel(d.title, d.description, d.unit)
+	for i, expr := range d.exprs {
+		p.addTarget(fmt.Sprintf(expr, selector, selector+pollerSelector), d.legends[i])
+	}
+	return p
+}
+
+// metricUnit 按 Prometheus 的命名惯例从指标名推断单位, counter 为每秒的速率
+func metricUnit(def public.MetricDef) string {
+	name := strings.TrimSuffix(def.Name, "_total")
+	counter := def.Type == public.MetricCounter
+	switch {
+	case strings.HasSuffix(name, "_timestamp_seconds"):
+		return "dateTimeFromNow"
+	case strings.HasSuffix(name, "_seconds") && counter:
+		// 每秒花费的秒数, 即忙碌的比例
+		return "percentunit"
+	case strings.HasSuffix(name, "_seconds"):
+		return "s"
+	case (strings.HasSuffix(name, "_bytes") || strings.HasPrefix(name, "bytes_")) && counter:
+		return "Bps"
+	case strings.HasSuffix(name, "_bytes") || strings.HasPrefix(name, "bytes_"):
+		return "bytes"
+	case strings.HasSuffix(name, "_ratio"):
+		return "percentunit"
+	case counter:
+		return "cps"
+	}
+	return "short"
+}
+
+// sum 按 by 聚合 expr, by 为空时聚合为一条曲线
+func sum(by []string, expr string) string {
+	if len(by) == 0 {
+		return fmt.Sprintf("sum(%s)", expr)
+	}
+	return fmt.Sprintf("sum by (%s) (%s)", strings.Join(by, ", "), expr)
+}
+
+// legend 由 prefix 和各聚合标签组成, 都为空时为 fallback
+func legend(prefix string, by []string, fallback string) string {
+	parts := make([]string, 0, len(by)+1)
+	if prefix != "" {
+		parts = append(parts, prefix)
+	}
+	for _, label := range by {
+		parts = append(parts, "{{"+label+"}}")
+	}
+	if len(parts) == 0 {
+		return fallback
+	}
+	return strings.Join(parts, " ")
+}
+
+// layout 从左到右, 从上到下排列面板, 每行 3 个
+type layout struct {
+	panels []panel
+	x, y   int
+}
+
+func (l *layout) nextID() int {
+	return len(l.panels) + 1
+}
+
+// row 开始新的一行标题, repeat 不为空时按该变量的每个取值重复这一行及其下的面板
+func (l *layout) row(title, repeat string) {
+	if l.x > 0 {
+		l.x, l.y = 0, l.y+panelHeight
+	}
+	l.panels = append(l.panels, panel{
+		Collapsed: new(bool),
+		GridPos:   gridPos{H: 1, W: gridWidth, X: 0, Y: l.y},
+		ID:        l.nextID(),
+		Panels:    []panel{},
+		Repeat:    repeat,
+		Title:     title,
+		Type:      "row",
+	})
+	l.y++
+}
+
+func (l *layout) add(p panel) {
+	p.ID = l.nextID()
+	p.GridPos = gridPos{H: panelHeight, W: panelWidth, X: l.x, Y: l.y}
+	l.panels = append(l.panels, p)
+	if l.x += panelWidth; l.x >= gridWidth {
+		l.x, l.y = 0, l.y+panelHeight
+	}
+}
+
+func queryVariable(name, query string) variable {
+	return variable{
+		AllValue:   ".*",
+		Current:    map[string]any{},
+		Datasource: prometheus,
+		IncludeAll: true,
+		Multi:      true,
+		Name:       name,
+		Options:    []any{},
+		Query:      query,
+		Refresh:    2,
+		Type:       "query",
+	}
+}
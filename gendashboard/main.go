@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"server_millionclient/public"
+
+	"go.uber.org/zap"
+)
+
+// 按 public 中的指标定义生成 grafana-dashboard.json, 新增的指标自动得到面板:
+// go generate ./public 或 go run ./gendashboard -out grafana-dashboard.json. 不要手工修改生成的文件
+var (
+	out   = flag.String("out", "grafana-dashboard.json", "output file")
+	check = flag.Bool("check", false, "only check that -out is up to date with the metric definitions, exit 1 if not")
+)
+
+func main() {
+	flag.Parse()
+	public.InitLogger(false)
+
+	d := newDashboard(public.MetricDefs())
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	// 查询中的 < > & 保持原样, 便于阅读和 diff
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(d); err != nil {
+		public.Logger.Fatal("encode dashboard failed", zap.Error(err))
+	}
+
+	if *check {
+		old, err := os.ReadFile(*out)
+		if err != nil {
+			public.Logger.Fatal("read dashboard failed", zap.Error(err))
+		}
+		if !bytes.Equal(old, buf.Bytes()) {
+			public.Logger.Fatal("dashboard is out of date, run go generate ./public", zap.String("out", *out))
+		}
+		public.Logger.Info("dashboard is up to date", zap.String("out", *out))
+		return
+	}
+	if err := os.WriteFile(*out, buf.Bytes(), 0o644); err != nil {
+		public.Logger.Fatal("write dashboard failed", zap.Error(err))
+	}
+	public.Logger.Info("dashboard generated", zap.String("out", *out), zap.Int("panels", d.panelCount()))
+}
@@ -0,0 +1,181 @@
+package main
+
+// grafana dashboard JSON 中用到的部分, 字段顺序与 grafana 导出的一致
+
+var prometheus = datasource{Type: "prometheus", UID: "${DS_PROMETHEUS}"}
+
+type dashboard struct {
+	Inputs               []input        `json:"__inputs"`
+	Elements             map[string]any `json:"__elements"`
+	Requires             []require      `json:"__requires"`
+	Annotations          annotations    `json:"annotations"`
+	Editable             bool           `json:"editable"`
+	FiscalYearStartMonth int            `json:"fiscalYearStartMonth"`
+	GraphTooltip         int            `json:"graphTooltip"`
+	ID                   *int           `json:"id"`
+	Links                []any          `json:"links"`
+	Panels               []panel        `json:"panels"`
+	Refresh              string         `json:"refresh"`
+	SchemaVersion        int            `json:"schemaVersion"`
+	Tags                 []string       `json:"tags"`
+	Templating           templating     `json:"templating"`
+	Time                 timeRange      `json:"time"`
+	Timepicker           map[string]any `json:"timepicker"`
+	Timezone             string         `json:"timezone"`
+	Title                string         `json:"title"`
+	UID                  string         `json:"uid"`
+	Version              int            `json:"version"`
+	WeekStart            string         `json:"weekStart"`
+}
+
+func (d *dashboard) panelCount() int {
+	n := 0
+	for _, p := range d.Panels {
+		if p.Type != "row" {
+			n++
+		}
+	}
+	return n
+}
+
+type input struct {
+	Name        string `json:"name"`
+	Label       string `json:"label"`
+	Description string `json:"description"`
+	Type        string `json:"type"`
+	PluginID    string `json:"pluginId"`
+	PluginName  string `json:"pluginName"`
+}
+
+type require struct {
+	Type    string `json:"type"`
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type annotations struct {
+	List []annotation `json:"list"`
+}
+
+type annotation struct {
+	BuiltIn    int        `json:"builtIn"`
+	Datasource datasource `json:"datasource"`
+	Enable     bool       `json:"enable"`
+	Hide       bool       `json:"hide"`
+	IconColor  string     `json:"iconColor"`
+	Name       string     `json:"name"`
+	Type       string     `json:"type"`
+}
+
+type datasource struct {
+	Type string `json:"type"`
+	UID  string `json:"uid"`
+}
+
+type templating struct {
+	List []variable `json:"list"`
+}
+
+type variable struct {
+	AllValue   string         `json:"allValue"`
+	Current    map[string]any `json:"current"`
+	Datasource datasource     `json:"datasource"`
+	IncludeAll bool           `json:"includeAll"`
+	Multi      bool           `json:"multi"`
+	Name       string         `json:"name"`
+	Options    []any          `json:"options"`
+	Query      string         `json:"query"`
+	Refresh    int            `json:"refresh"`
+	Regex      string         `json:"regex"`
+	Type       string         `json:"type"`
+}
+
+type timeRange struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// panel timeseries 面板或 row. row 没有 datasource, fieldConfig 等字段
+type panel struct {
+	Collapsed   *bool        `json:"collapsed,omitempty"`
+	Datasource  *datasource  `json:"datasource,omitempty"`
+	Description string       `json:"description,omitempty"`
+	FieldConfig *fieldConfig `json:"fieldConfig,omitempty"`
+	GridPos     gridPos      `json:"gridPos"`
+	ID          int          `json:"id"`
+	Options     *options     `json:"options,omitempty"`
+	Panels      []panel      `json:"panels,omitempty"`
+	Repeat      string       `json:"repeat,omitempty"`
+	Targets     []target     `json:"targets,omitempty"`
+	Title       string       `json:"title"`
+	Type        string       `json:"type"`
+}
+
+func newPanel(title, description, unit string) panel {
+	return panel{
+		Datasource:  &prometheus,
+		Description: description,
+		FieldConfig: &fieldConfig{Defaults: fieldDefaults{Unit: unit}, Overrides: []any{}},
+		Options: &options{
+			Legend:  legendOptions{Calcs: []string{}, DisplayMode: "list", Placement: "bottom", ShowLegend: true},
+			Tooltip: tooltipOptions{Mode: "multi", Sort: "desc"},
+		},
+		Title: title,
+		Type:  "timeseries",
+	}
+}
+
+// addTarget 添加一个查询, refId 依次为 A, B, C...
+func (p *panel) addTarget(expr, legend string) {
+	p.Targets = append(p.Targets, target{
+		Datasource:   prometheus,
+		EditorMode:   "code",
+		Expr:         expr,
+		LegendFormat: legend,
+		Range:        true,
+		RefID:        string(rune('A' + len(p.Targets))),
+	})
+}
+
+type fieldConfig struct {
+	Defaults  fieldDefaults `json:"defaults"`
+	Overrides []any         `json:"overrides"`
+}
+
+type fieldDefaults struct {
+	Unit string `json:"unit"`
+}
+
+type gridPos struct {
+	H int `json:"h"`
+	W int `json:"w"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type options struct {
+	Legend  legendOptions  `json:"legend"`
+	Tooltip tooltipOptions `json:"tooltip"`
+}
+
+type legendOptions struct {
+	Calcs       []string `json:"calcs"`
+	DisplayMode string   `json:"displayMode"`
+	Placement   string   `json:"placement"`
+	ShowLegend  bool     `json:"showLegend"`
+}
+
+type tooltipOptions struct {
+	Mode string `json:"mode"`
+	Sort string `json:"sort"`
+}
+
+type target struct {
+	Datasource   datasource `json:"datasource"`
+	EditorMode   string     `json:"editorMode"`
+	Expr         string     `json:"expr"`
+	LegendFormat string     `json:"legendFormat"`
+	Range        bool       `json:"range"`
+	RefID        string     `json:"refId"`
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"server_millionclient/otlpsink/receiver"
+	"server_millionclient/public"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 本地验证 OTLP 导出用的接收端, 打印收到的 span, 并定期汇总收到的指标以及客户端与服务端 span 串联的 trace 数:
+// go run ./otlpsink -addr 127.0.0.1:4318, 然后 server 和 client 都加上 -otlp-endpoint http://127.0.0.1:4318
+var (
+	addr     = flag.String("addr", "127.0.0.1:4318", "listen addr of the OTLP/HTTP receiver")
+	verbose  = flag.Bool("verbose", false, "log every received span")
+	interval = flag.Duration("summary-interval", 15*time.Second, "interval to log a summary of received spans and metrics")
+)
+
+func main() {
+	flag.Parse()
+	public.InitLogger(*verbose)
+
+	sink := receiver.New()
+	sink.OnSpan = func(s receiver.Span) {
+		public.Logger.Debug("span", zap.String("service", s.Service), zap.String("name", s.Name),
+			zap.String("traceID", s.TraceID), zap.String("spanID", s.SpanID), zap.String("parentID", s.ParentID),
+			zap.Duration("duration", s.End.Sub(s.Start)))
+	}
+	go func() {
+		for range time.Tick(*interval) {
+			summarize(sink)
+		}
+	}()
+
+	public.Logger.Info("otlp receiver started", zap.String("addr", *addr))
+	server := &http.Server{Addr: *addr, Handler: sink.Handler(), ReadHeaderTimeout: 10 * time.Second}
+	if err := server.ListenAndServe(); err != nil {
+		public.Logger.Fatal("listen error", zap.Error(err))
+	}
+}
+
+// summarize linked 为同时包含 client 与服务端 span 的 trace 数
+func summarize(sink *receiver.Receiver) {
+	services := make(map[string]map[string]bool) // trace id -> services
+	spans := sink.Spans()
+	for _, s := range spans {
+		if services[s.TraceID] == nil {
+			services[s.TraceID] = make(map[string]bool)
+		}
+		services[s.TraceID][s.Service] = true
+	}
+	var linked int
+	for _, svcs := range services {
+		if svcs["client"] && len(svcs) > 1 {
+			linked++
+		}
+	}
+	public.Logger.Info("received", zap.Int("spans", len(spans)), zap.Int("traces", len(services)),
+		zap.Int("linked", linked), zap.Int("metrics", len(sink.Metrics())))
+}
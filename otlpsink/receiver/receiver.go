@@ -0,0 +1,156 @@
+package receiver
+
+import (
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	colmetricpb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// Span Receiver 收到的一个 span
+type Span struct {
+	Service  string
+	Name     string
+	TraceID  string
+	SpanID   string
+	ParentID string
+	Start    time.Time
+	End      time.Time
+}
+
+// Receiver 进程内的 OTLP/HTTP(protobuf) 接收端, 记录收到的 span 和指标名.
+// 用于在没有 collector 的环境中验证导出, 以及检查客户端与服务端的 span 是否串联在同一个 trace 中
+type Receiver struct {
+	// OnSpan 不为 nil 时每收到一个 span 调用一次
+	OnSpan func(Span)
+
+	mu      sync.Mutex
+	spans   []Span
+	metrics map[string]int
+}
+
+func New() *Receiver {
+	return &Receiver{metrics: make(map[string]int)}
+}
+
+// Handler 提供 /v1/traces 和 /v1/metrics, 即 OTelConfig.Endpoint 指向的地址
+func (r *Receiver) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/traces", func(w http.ResponseWriter, req *http.Request) {
+		var msg coltracepb.ExportTraceServiceRequest
+		if !readOTLP(w, req, &msg) {
+			return
+		}
+		r.addSpans(&msg)
+		writeOTLP(w, &coltracepb.ExportTraceServiceResponse{})
+	})
+	mux.HandleFunc("POST /v1/metrics", func(w http.ResponseWriter, req *http.Request) {
+		var msg colmetricpb.ExportMetricsServiceRequest
+		if !readOTLP(w, req, &msg) {
+			return
+		}
+		r.addMetrics(&msg)
+		writeOTLP(w, &colmetricpb.ExportMetricsServiceResponse{})
+	})
+	return mux
+}
+
+// Spans 到目前为止收到的所有 span
+func (r *Receiver) Spans() []Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.spans)
+}
+
+// Metrics 收到过的指标名及其出现的次数(每次导出计一次)
+func (r *Receiver) Metrics() map[string]int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := make(map[string]int, len(r.metrics))
+	for name, n := range r.metrics {
+		m[name] = n
+	}
+	return m
+}
+
+func (r *Receiver) addSpans(msg *coltracepb.ExportTraceServiceRequest) {
+	var spans []Span
+	for _, rs := range msg.GetResourceSpans() {
+		var service string
+		for _, attr := range rs.GetResource().GetAttributes() {
+			if attr.GetKey() == "service.name" {
+				service = attr.GetValue().GetStringValue()
+			}
+		}
+		for _, ss := range rs.GetScopeSpans() {
+			for _, s := range ss.GetSpans() {
+				spans = append(spans, Span{
+					Service:  service,
+					Name:     s.GetName(),
+					TraceID:  hex.EncodeToString(s.GetTraceId()),
+					SpanID:   hex.EncodeToString(s.GetSpanId()),
+					ParentID: hex.EncodeToString(s.GetParentSpanId()),
+					Start:    time.Unix(0, int64(s.GetStartTimeUnixNano())),
+					End:      time.Unix(0, int64(s.GetEndTimeUnixNano())),
+				})
+			}
+		}
+	}
+	r.mu.Lock()
+	r.spans = append(r.spans, spans...)
+	r.mu.Unlock()
+	if r.OnSpan != nil {
+		for _, s := range spans {
+			r.OnSpan(s)
+		}
+	}
+}
+
+func (r *Receiver) addMetrics(msg *colmetricpb.ExportMetricsServiceRequest) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, rm := range msg.GetResourceMetrics() {
+		for _, sm := range rm.GetScopeMetrics() {
+			for _, m := range sm.GetMetrics() {
+				r.metrics[m.GetName()]++
+			}
+		}
+	}
+}
+
+// readOTLP 解析 protobuf 编码的请求, 支持 gzip 压缩. 失败时已经写入了错误响应
+func readOTLP(w http.ResponseWriter, req *http.Request, msg proto.Message) bool {
+	var body io.Reader = req.Body
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return false
+		}
+		defer gz.Close()
+		body = gz
+	}
+	data, err := io.ReadAll(body)
+	if err == nil {
+		err = proto.Unmarshal(data, msg)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("illegal otlp request: %v", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func writeOTLP(w http.ResponseWriter, msg proto.Message) {
+	data, _ := proto.Marshal(msg)
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	_, _ = w.Write(data)
+}
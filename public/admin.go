@@ -0,0 +1,227 @@
+package public
+
+import (
+	"cmp"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+// adminShutdownTimeout 关闭管理服务时等待进行中请求(如 pprof profile)的最长时间
+const adminShutdownTimeout = 5 * time.Second
+
+// Admin 管理 http 服务: /metrics, /healthz, /readyz, /connections/..., /log/level, 以及可选的 /debug/pprof.
+// 使用独立的 ServeMux, 不会暴露注册在 http.DefaultServeMux 上的 handler.
+// 修改状态的接口(DELETE /connections/{id}, PUT /log/level)需要 token, 见 authorize
+type Admin struct {
+	mux    *http.ServeMux
+	server *http.Server
+	ln     net.Listener
+	ready  atomic.Bool
+	conns  ConnInspector
+	token  string
+}
+
+// NewAdmin pprof 为 true 时注册 /debug/pprof. token 为修改状态的接口要求的 bearer token, 为空时禁用这些接口
+func NewAdmin(enablePprof bool, token string) *Admin {
+	a := &Admin{mux: http.NewServeMux(), token: token}
+	a.mux.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+	a.mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok\n"))
+	})
+	a.mux.HandleFunc("/readyz", a.serveReady)
+	a.mux.HandleFunc("GET /connections", a.serveConnections)
+	a.mux.HandleFunc("GET /connections/top", a.serveTopConnections)
+	a.mux.HandleFunc("GET /connections/{id}", a.serveConnection)
+	a.mux.Handle("DELETE /connections/{id}", a.authorize(http.HandlerFunc(a.closeConnection)))
+	// GET 返回当前级别, PUT {"level":"debug"} 修改级别
+	a.mux.Handle("GET /log/level", LogLevel)
+	a.mux.Handle("/log/level", a.authorize(LogLevel))
+	if enablePprof {
+		a.mux.HandleFunc("/debug/pprof/", pprof.Index)
+		a.mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+		a.mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+		a.mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+		a.mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	}
+	return a
+}
+
+// Handle 注册其他管理接口, 需要在 Start 之前调用
+func (a *Admin) Handle(pattern string, handler http.Handler) {
+	a.mux.Handle(pattern, handler)
+}
+
+// HandleConnections 设置 /connections 系列接口的数据来源, 一般为 NewInspector(registry, ...)
+func (a *Admin) HandleConnections(inspector ConnInspector) {
+	a.conns = inspector
+}
+
+// Start 监听 addr 并在后台提供服务, 监听失败时返回错误. addr 为空时不启动.
+// inherited 不为 nil 时直接使用 handoff 交接来的 listener(Inheritance.Admin), 不再监听.
+// 不使用 reuseport, 同一时刻只有一个进程在端口上提供服务, handoff 时随 listener 一起交给新进程, 见 Listener
+func (a *Admin) Start(addr string, inherited net.Listener) error {
+	if addr == "" {
+		if inherited != nil {
+			_ = inherited.Close()
+		}
+		return nil
+	}
+	ln := inherited
+	if ln == nil {
+		var err error
+		if ln, err = net.Listen("tcp", addr); err != nil {
+			return err
+		}
+	}
+	a.ln = ln
+	a.server = &http.Server{Handler: a.mux, ReadHeaderTimeout: 10 * time.Second}
+	Logger.Info("admin server started", zap.Stringer("addr", ln.Addr()), zap.Bool("inherited", inherited != nil))
+	go func() {
+		// handoff 之后 listener 由新进程使用, 当前进程中已经关闭
+		if err := a.server.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, net.ErrClosed) {
+			Logger.Error("admin server failed", zap.Error(err))
+		}
+	}()
+	return nil
+}
+
+// Listener 管理服务的 listener, 没有启动时为 nil. handoff 时放入 Inheritance.Admin 交给新进程,
+// 之后当前进程不再接受管理请求
+func (a *Admin) Listener() net.Listener {
+	return a.ln
+}
+
+// SetReady 所有 listener 和事件循环都启动之后调用, 之后 /readyz 返回 200
+func (a *Admin) SetReady(ready bool) {
+	a.ready.Store(ready)
+	Logger.Info("admin ready", zap.Bool("ready", ready))
+}
+
+// Shutdown 随主服务一起退出: /readyz 先返回 503, 然后等待进行中的请求结束
+func (a *Admin) Shutdown() {
+	a.ready.Store(false)
+	if a.server == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), adminShutdownTimeout)
+	defer cancel()
+	if err := a.server.Shutdown(ctx); err != nil {
+		Logger.Warn("admin server shutdown failed", zap.Error(err))
+		return
+	}
+	Logger.Info("admin server stopped")
+}
+
+// authorize 要求请求带有 Authorization: Bearer <token>. 没有配置 token 时返回 403, token 不对时返回 401
+func (a *Admin) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.token == "" {
+			http.Error(w, "disabled, set -admin-token to enable", http.StatusForbidden)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *Admin) serveReady(w http.ResponseWriter, r *http.Request) {
+	if !a.ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+func (a *Admin) serveConnections(w http.ResponseWriter, r *http.Request) {
+	if a.conns == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, a.conns.Summary(time.Now()))
+}
+
+// serveTopConnections ?by=bytes_in|bytes_out|frames_in|frames_out|age|idle&n=10
+func (a *Admin) serveTopConnections(w http.ResponseWriter, r *http.Request) {
+	if a.conns == nil {
+		http.NotFound(w, r)
+		return
+	}
+	by := cmp.Or(r.URL.Query().Get("by"), "bytes_in")
+	n := 10
+	if s := r.URL.Query().Get("n"); s != "" {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil || n <= 0 {
+			http.Error(w, "illegal n", http.StatusBadRequest)
+			return
+		}
+	}
+	infos, err := a.conns.Top(time.Now(), by, n)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, infos)
+}
+
+func (a *Admin) serveConnection(w http.ResponseWriter, r *http.Request) {
+	id, ok := a.connID(w, r)
+	if !ok {
+		return
+	}
+	info, ok := a.conns.Get(time.Now(), id)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, info)
+}
+
+func (a *Admin) closeConnection(w http.ResponseWriter, r *http.Request) {
+	id, ok := a.connID(w, r)
+	if !ok {
+		return
+	}
+	if !a.conns.Close(id) {
+		http.NotFound(w, r)
+		return
+	}
+	_, _ = w.Write([]byte("closed\n"))
+}
+
+// connID 解析路径中的连接 ID, 失败时已经写入了错误响应
+func (a *Admin) connID(w http.ResponseWriter, r *http.Request) (uint64, bool) {
+	if a.conns == nil {
+		http.NotFound(w, r)
+		return 0, false
+	}
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "illegal connection id", http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
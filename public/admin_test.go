@@ -0,0 +1,91 @@
+package public
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+// TestAdminAuthorize 修改状态的接口只在配置了 -admin-token 并带有正确的 token 时可用, 查询接口不需要 token
+func TestAdminAuthorize(t *testing.T) {
+	Logger = zaptest.NewLogger(t)
+	registry := NewRegistry[int]()
+	closed := make(map[int]bool)
+	for i := range 3 {
+		registry.Add(i, &Peer{ID: uint64(i + 1), ConnectedAt: time.Now()})
+	}
+	inspector := NewInspector(registry, func(conn int) {
+		closed[conn] = true
+		registry.Remove(conn)
+	})
+
+	for _, tt := range []struct {
+		name   string
+		token  string
+		method string
+		path   string
+		auth   string
+		want   int
+	}{
+		{name: "get without token", method: http.MethodGet, path: "/connections/2", want: http.StatusOK},
+		{name: "get level without token", method: http.MethodGet, path: "/log/level", want: http.StatusOK},
+		{name: "delete disabled", method: http.MethodDelete, path: "/connections/2", auth: "Bearer secret", want: http.StatusForbidden},
+		{name: "put level disabled", method: http.MethodPut, path: "/log/level", auth: "Bearer secret", want: http.StatusForbidden},
+		{name: "delete without auth", token: "secret", method: http.MethodDelete, path: "/connections/2", want: http.StatusUnauthorized},
+		{name: "delete wrong token", token: "secret", method: http.MethodDelete, path: "/connections/2", auth: "Bearer wrong", want: http.StatusUnauthorized},
+		{name: "put level wrong token", token: "secret", method: http.MethodPut, path: "/log/level", auth: "Bearer wrong", want: http.StatusUnauthorized},
+		{name: "delete", token: "secret", method: http.MethodDelete, path: "/connections/2", auth: "Bearer secret", want: http.StatusOK},
+		{name: "delete closed", token: "secret", method: http.MethodDelete, path: "/connections/2", auth: "Bearer secret", want: http.StatusNotFound},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			admin := NewAdmin(false, tt.token)
+			admin.HandleConnections(inspector)
+			body := ""
+			if tt.method == http.MethodPut {
+				body = `{"level":"info"}`
+			}
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(body))
+			if tt.auth != "" {
+				req.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			admin.mux.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("%s %s = %d %q, want %d", tt.method, tt.path, w.Code, w.Body.String(), tt.want)
+			}
+		})
+	}
+	if !closed[1] || len(closed) != 1 {
+		t.Fatalf("closed = %v, want only conn 1", closed)
+	}
+}
+
+// TestRegistryLookup ID 索引随 Add/Remove 更新, 删除时填补空位的连接仍然可以找到
+func TestRegistryLookup(t *testing.T) {
+	registry := NewRegistry[int]()
+	for i := range 4 {
+		registry.Add(i, &Peer{ID: uint64(i + 100)})
+	}
+	registry.Remove(1)
+	if _, _, ok := registry.Lookup(101); ok {
+		t.Fatal("removed conn still found")
+	}
+	for _, i := range []int{0, 2, 3} {
+		conn, peer, ok := registry.Lookup(uint64(i + 100))
+		if !ok || conn != i || peer.ID != uint64(i+100) {
+			t.Fatalf("Lookup(%d) = %d, %v, %v", i+100, conn, peer, ok)
+		}
+	}
+	// 替换 Peer 之后只能按新的 ID 找到
+	registry.Add(3, &Peer{ID: 200})
+	if _, _, ok := registry.Lookup(103); ok {
+		t.Fatal("replaced peer still found")
+	}
+	if conn, _, ok := registry.Lookup(200); !ok || conn != 3 {
+		t.Fatalf("Lookup(200) = %d, %v", conn, ok)
+	}
+}
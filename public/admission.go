@@ -0,0 +1,164 @@
+package public
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// 拒绝连接的原因, 对应 RejectedConnections 的 reason 标签
+const (
+	RejectMaxConns    = "max_conns"
+	RejectAcceptRate  = "accept_rate"
+	RejectFdExhausted = "fd_exhausted"
+	RejectMemory      = "memory_pressure"
+	// RejectHandshakeQueue tls 握手队列或 worker pool 已满
+	RejectHandshakeQueue = "handshake_queue"
+	// RejectProxyHeader 开启 PROXY protocol 后连接没有发送合法的 PROXY 头
+	RejectProxyHeader = "proxy_header"
+)
+
+const (
+	acceptBackoffMin = 5 * time.Millisecond
+	acceptBackoffMax = time.Second
+)
+
+// Admission 准入控制: 限制并发连接数与 accept 速率, 拒绝连接或 fd 耗尽(EMFILE/ENFILE)时退避.
+// 可以被多个 accept 循环共享
+type Admission struct {
+	maxConns   int64
+	acceptRate float64
+	active     atomic.Int64
+
+	lock   sync.Mutex
+	bucket tokenBucket
+	// spare 预留的 fd, fd 耗尽时释放它来 accept 并关闭一个连接, 避免 backlog 中的连接一直挂起
+	spare   *os.File
+	backoff time.Duration
+}
+
+// NewAdmission maxConns/acceptRate 为 0 表示不限制
+func NewAdmission(maxConns int, acceptRate float64) *Admission {
+	a := &Admission{maxConns: int64(maxConns), acceptRate: acceptRate}
+	a.reserveSpare()
+	return a
+}
+
+// Accept 从 ln 接受一个通过准入检查的连接. 被拒绝的连接直接关闭, 不会返回给调用方.
+// 返回的 error 与 ln.Accept 一致
+func (a *Admission) Accept(ln net.Listener) (net.Conn, error) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) {
+				AcceptErrors.WithLabelValues(RejectFdExhausted).Inc()
+				a.shed(ln)
+				continue
+			}
+			if !errors.Is(err, net.ErrClosed) {
+				AcceptErrors.WithLabelValues(acceptErrorReason(err)).Inc()
+			}
+			return nil, err
+		}
+		if reason := a.Admit(); reason != "" {
+			_ = conn.Close()
+			// 超过上限时 backlog 中的连接会被逐个 accept 再关闭, 与 fd 耗尽一样退避, 不在这里空转
+			time.Sleep(a.nextBackoff())
+			continue
+		}
+		a.lock.Lock()
+		a.backoff = 0
+		a.lock.Unlock()
+		return conn, nil
+	}
+}
+
+// acceptErrorReason AcceptErrors 的 reason 标签, fd 耗尽时为 RejectFdExhausted
+func acceptErrorReason(err error) string {
+	switch {
+	case errors.Is(err, syscall.ECONNABORTED):
+		return "aborted"
+	case errors.Is(err, syscall.ENOBUFS), errors.Is(err, syscall.ENOMEM):
+		return "no_memory"
+	}
+	return "other"
+}
+
+// Admit 检查并占用一个连接名额, 返回非空的拒绝原因表示不接受该连接.
+// 供自己 accept 的 backend(gnet) 使用, 通过后需在连接关闭时调用 Release
+func (a *Admission) Admit() (reason string) {
+	if CurrentMemoryStage() >= MemoryStopAccept {
+		reason = RejectMemory
+	} else if a.maxConns > 0 && a.active.Load() >= a.maxConns {
+		reason = RejectMaxConns
+	} else if a.acceptRate > 0 {
+		a.lock.Lock()
+		if !a.bucket.allow(a.acceptRate, 1, time.Now()) {
+			reason = RejectAcceptRate
+		}
+		a.lock.Unlock()
+	}
+	if reason != "" {
+		RejectedConnections.WithLabelValues(reason).Inc()
+		return reason
+	}
+	a.active.Add(1)
+	return ""
+}
+
+// Track 占用一个名额但不做检查, 用于 handoff 继承来的连接
+func (a *Admission) Track() {
+	a.active.Add(1)
+}
+
+// Release 连接关闭时归还名额
+func (a *Admission) Release() {
+	a.active.Add(-1)
+}
+
+// shed fd 耗尽时释放预留 fd, 取出并关闭一个连接, 然后退避
+func (a *Admission) shed(ln net.Listener) {
+	a.lock.Lock()
+	if a.spare != nil {
+		_ = a.spare.Close()
+		a.spare = nil
+	}
+	a.lock.Unlock()
+	backoff := a.nextBackoff()
+
+	if conn, err := ln.Accept(); err == nil {
+		_ = conn.Close()
+		RejectedConnections.WithLabelValues(RejectFdExhausted).Inc()
+	}
+	Logger.Error("fd exhausted, backing off", zap.Duration("backoff", backoff))
+	time.Sleep(backoff)
+	a.reserveSpare()
+}
+
+// nextBackoff 连续失败时退避的时长指数增长, 直到接受一个连接后重置
+func (a *Admission) nextBackoff() time.Duration {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.backoff = min(max(a.backoff*2, acceptBackoffMin), acceptBackoffMax)
+	return a.backoff
+}
+
+func (a *Admission) reserveSpare() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.spare != nil {
+		return
+	}
+	spare, err := os.Open(os.DevNull)
+	if err != nil {
+		Logger.Error("reserve spare fd failed", zap.Error(err))
+		return
+	}
+	a.spare = spare
+}
@@ -0,0 +1,366 @@
+package public
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// LoadCertPool 从 PEM 文件加载 CA 证书池
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	raw, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read ca file failed: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(raw) {
+		return nil, fmt.Errorf("no certificate found in %s", caFile)
+	}
+	return pool, nil
+}
+
+// CertKeyPair PEM 编码的证书及私钥
+type CertKeyPair struct {
+	Cert *x509.Certificate
+	Key  *ecdsa.PrivateKey
+	// CertPEM/KeyPEM 写入文件的内容
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// GenerateCA 生成自签名 CA
+func GenerateCA(validFor time.Duration) (*CertKeyPair, error) {
+	tmpl := &x509.Certificate{
+		Subject:               pkix.Name{Organization: []string{"server_millionclient"}, CommonName: "1m test CA"},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	return generate(tmpl, nil, validFor)
+}
+
+// GenerateServerCert 由 ca 签发服务端证书, hosts 为 DNS 名或 IP
+func GenerateServerCert(ca *CertKeyPair, hosts []string, validFor time.Duration) (*CertKeyPair, error) {
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{Organization: []string{"server_millionclient"}, CommonName: hosts[0]},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, host)
+		}
+	}
+	return generate(tmpl, ca, validFor)
+}
+
+// GenerateClientCert 由 ca 签发客户端证书, name 作为证书的 CommonName, 即服务端看到的客户端身份
+func GenerateClientCert(ca *CertKeyPair, name string, validFor time.Duration) (*CertKeyPair, error) {
+	tmpl := &x509.Certificate{
+		Subject:     pkix.Name{Organization: []string{"server_millionclient"}, CommonName: name},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	return generate(tmpl, ca, validFor)
+}
+
+func generate(tmpl *x509.Certificate, parent *CertKeyPair, validFor time.Duration) (*CertKeyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generate key failed: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, fmt.Errorf("generate serial number failed: %w", err)
+	}
+	tmpl.SerialNumber = serial
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(validFor)
+
+	parentCert, signer := tmpl, key
+	if parent != nil {
+		parentCert, signer = parent.Cert, parent.Key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, signer)
+	if err != nil {
+		return nil, fmt.Errorf("create certificate failed: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate failed: %w", err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("marshal private key failed: %w", err)
+	}
+	return &CertKeyPair{
+		Cert:    cert,
+		Key:     key,
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer}),
+	}, nil
+}
+
+// TLSCertificate 转换为 tls.Certificate
+func (p *CertKeyPair) TLSCertificate() (tls.Certificate, error) {
+	return tls.X509KeyPair(p.CertPEM, p.KeyPEM)
+}
+
+// ParseClientAuth 解析服务端校验客户端证书的方式
+func ParseClientAuth(s string) (tls.ClientAuthType, error) {
+	switch s {
+	case "", "none":
+		return tls.NoClientCert, nil
+	case "request":
+		return tls.RequestClientCert, nil
+	case "require":
+		return tls.RequireAnyClientCert, nil
+	case "verify-if-given":
+		return tls.VerifyClientCertIfGiven, nil
+	case "require-verify":
+		return tls.RequireAndVerifyClientCert, nil
+	}
+	return tls.NoClientCert, fmt.Errorf("unknown client auth: %s", s)
+}
+
+// TLSIdentity 从已完成握手的连接中取出经过校验的客户端身份:
+// 依次取 SAN 中的 URI, DNS, Email, 都没有时取 Subject CommonName. 没有经过校验的证书时返回空串
+func TLSIdentity(state tls.ConnectionState) string {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	leaf := state.VerifiedChains[0][0]
+	switch {
+	case len(leaf.URIs) > 0:
+		return leaf.URIs[0].String()
+	case len(leaf.DNSNames) > 0:
+		return leaf.DNSNames[0]
+	case len(leaf.EmailAddresses) > 0:
+		return leaf.EmailAddresses[0]
+	}
+	return leaf.Subject.CommonName
+}
+
+// LoadClientCerts 加载 dir 下所有的 <name>.pem + <name>-key.pem 客户端证书, 按文件名排序
+func LoadClientCerts(dir string) ([]tls.Certificate, error) {
+	keyFiles, err := filepath.Glob(filepath.Join(dir, "*-key.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("glob key files failed: %w", err)
+	}
+	sort.Strings(keyFiles)
+	certs := make([]tls.Certificate, 0, len(keyFiles))
+	for _, keyFile := range keyFiles {
+		cert, err := tls.LoadX509KeyPair(strings.TrimSuffix(keyFile, "-key.pem")+".pem", keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate failed: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no client certificate found in %s", dir)
+	}
+	return certs, nil
+}
+
+// CertReloader 持有当前的服务端证书, 通过 tls.Config.GetCertificate 提供给握手使用.
+// dir 不为空时还会加载其中每个主机名一对的 <host>.pem + <host>-key.pem, 按 SNI 匹配证书的 DNS 名(支持通配符)选择,
+// 匹配不到时使用默认证书. 收到 SIGHUP 或证书文件/目录修改时间变化时重新加载, 已建立的会话不受影响
+type CertReloader struct {
+	certFile, keyFile, dir string
+
+	cert    atomic.Pointer[tls.Certificate]
+	tenants atomic.Pointer[map[string]tenantCert]
+	modTime time.Time
+	dirTime time.Time
+}
+
+// tenantCert 目录中的证书及其所属租户(文件名中的主机名)
+type tenantCert struct {
+	tenant string
+	cert   *tls.Certificate
+}
+
+// NewCertReloader 立即加载一次证书, 失败时返回 error. dir 为空时只使用 certFile/keyFile
+func NewCertReloader(certFile, keyFile, dir string) (*CertReloader, error) {
+	r := &CertReloader{certFile: certFile, keyFile: keyFile, dir: dir}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	if tc, ok := r.match(hello.ServerName); ok {
+		return tc.cert, nil
+	}
+	return r.cert.Load(), nil
+}
+
+// Tenant 返回 SNI serverName 所属的租户, 匹配不到目录中的证书时为 DefaultTenant.
+// 租户只来自证书目录, 可以直接作为 metrics 的标签
+func (r *CertReloader) Tenant(serverName string) string {
+	if tc, ok := r.match(serverName); ok {
+		return tc.tenant
+	}
+	return DefaultTenant
+}
+
+// match 先精确匹配, 再把第一段换成 * 匹配通配符证书
+func (r *CertReloader) match(serverName string) (tenantCert, bool) {
+	tenants := r.tenants.Load()
+	if tenants == nil || serverName == "" {
+		return tenantCert{}, false
+	}
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	if tc, ok := (*tenants)[name]; ok {
+		return tc, true
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if tc, ok := (*tenants)["*"+name[i:]]; ok {
+			return tc, true
+		}
+	}
+	return tenantCert{}, false
+}
+
+// Reload 重新加载默认证书和证书目录, 任一失败时全部继续使用旧证书
+func (r *CertReloader) Reload() error {
+	modTime, dirTime := fileModTime(r.certFile), fileModTime(r.dir)
+	cert, err := loadCertificate(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	var tenants map[string]tenantCert
+	if r.dir != "" {
+		if tenants, err = loadTenantCerts(r.dir); err != nil {
+			return err
+		}
+	}
+	r.cert.Store(cert)
+	var old map[string]tenantCert
+	if p := r.tenants.Swap(&tenants); p != nil {
+		old = *p
+	}
+	r.modTime, r.dirTime = modTime, dirTime
+	observeCertExpiry(cert, old, tenants)
+	Logger.Info("certificate loaded", zap.String("file", r.certFile),
+		zap.String("subject", cert.Leaf.Subject.String()), zap.Time("notAfter", cert.Leaf.NotAfter),
+		zap.Int("tenantNames", len(tenants)))
+	return nil
+}
+
+// observeCertExpiry 先设置新证书的过期时间, 再删除已经没有证书的租户,
+// 不用 Reset 清空之后重新设置, 否则期间的抓取会看不到任何过期时间
+func observeCertExpiry(cert *tls.Certificate, old, tenants map[string]tenantCert) {
+	CertExpiry.WithLabelValues(DefaultTenant).Set(float64(cert.Leaf.NotAfter.Unix()))
+	current := map[string]bool{DefaultTenant: true}
+	for _, tc := range tenants {
+		CertExpiry.WithLabelValues(tc.tenant).Set(float64(tc.cert.Leaf.NotAfter.Unix()))
+		current[tc.tenant] = true
+	}
+	for _, tc := range old {
+		if !current[tc.tenant] {
+			CertExpiry.DeleteLabelValues(tc.tenant)
+		}
+	}
+}
+
+func loadCertificate(certFile, keyFile string) (*tls.Certificate, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate failed: %w", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("parse certificate failed: %w", err)
+	}
+	cert.Leaf = leaf
+	return &cert, nil
+}
+
+// loadTenantCerts 加载 dir 下所有的 <host>.pem + <host>-key.pem, 以证书中的每个 DNS 名为 key, host 为租户
+func loadTenantCerts(dir string) (map[string]tenantCert, error) {
+	keyFiles, err := filepath.Glob(filepath.Join(dir, "*-key.pem"))
+	if err != nil {
+		return nil, fmt.Errorf("glob key files failed: %w", err)
+	}
+	sort.Strings(keyFiles)
+	tenants := make(map[string]tenantCert)
+	for _, keyFile := range keyFiles {
+		certFile := strings.TrimSuffix(keyFile, "-key.pem") + ".pem"
+		cert, err := loadCertificate(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", certFile, err)
+		}
+		tenant := strings.ToLower(strings.TrimSuffix(filepath.Base(keyFile), "-key.pem"))
+		names := cert.Leaf.DNSNames
+		if len(names) == 0 {
+			names = []string{tenant}
+		}
+		for _, name := range names {
+			tenants[strings.ToLower(name)] = tenantCert{tenant: tenant, cert: cert}
+		}
+	}
+	return tenants, nil
+}
+
+// Watch 阻塞等待 SIGHUP 或者每 interval 检查一次证书文件的修改时间(interval <= 0 时只响应 SIGHUP), 直到 ctx 结束
+func (r *CertReloader) Watch(ctx context.Context, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+		case <-tick:
+			// key 通常与证书一起替换, 只看证书文件; 目录中增删或替换(rename)文件会改变目录的修改时间
+			modTime, dirTime := fileModTime(r.certFile), fileModTime(r.dir)
+			if modTime.IsZero() || modTime.Equal(r.modTime) && dirTime.Equal(r.dirTime) {
+				continue
+			}
+		}
+		if err := r.Reload(); err != nil {
+			Logger.Error("reload certificate failed", zap.Error(err))
+		}
+	}
+}
+
+func fileModTime(name string) time.Time {
+	if name == "" {
+		return time.Time{}
+	}
+	info, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
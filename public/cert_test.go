@@ -0,0 +1,64 @@
+package public
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap/zaptest"
+)
+
+// writeCert 由 ca 签发 hosts 的证书, 写入 dir 下的 <name>.pem 与 <name>-key.pem
+func writeCert(t *testing.T, ca *CertKeyPair, dir, name string, hosts ...string) {
+	t.Helper()
+	pair, err := GenerateServerCert(ca, hosts, time.Hour)
+	if err != nil {
+		t.Fatalf("generate cert: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".pem"), pair.CertPEM, 0o600); err != nil {
+		t.Fatalf("write cert: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+"-key.pem"), pair.KeyPEM, 0o600); err != nil {
+		t.Fatalf("write key: %v", err)
+	}
+}
+
+// TestCertReloadExpiry 重新加载之后保留仍然存在的租户的过期时间, 只删除证书已经移除的租户
+func TestCertReloadExpiry(t *testing.T) {
+	Logger = zaptest.NewLogger(t)
+	CertExpiry.Reset()
+	t.Cleanup(CertExpiry.Reset)
+	ca, err := GenerateCA(time.Hour)
+	if err != nil {
+		t.Fatalf("generate ca: %v", err)
+	}
+	base, dir := t.TempDir(), t.TempDir()
+	writeCert(t, ca, base, "server", "localhost")
+	writeCert(t, ca, dir, "a.example.com", "a.example.com", "www.a.example.com")
+	writeCert(t, ca, dir, "b.example.com", "b.example.com")
+
+	r, err := NewCertReloader(filepath.Join(base, "server.pem"), filepath.Join(base, "server-key.pem"), dir)
+	if err != nil {
+		t.Fatalf("NewCertReloader: %v", err)
+	}
+	if n := testutil.CollectAndCount(CertExpiry); n != 3 {
+		t.Fatalf("expiry series = %d, want 3", n)
+	}
+
+	if err := os.Remove(filepath.Join(dir, "b.example.com-key.pem")); err != nil {
+		t.Fatalf("remove key: %v", err)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if n := testutil.CollectAndCount(CertExpiry); n != 2 {
+		t.Fatalf("expiry series after removing a tenant = %d, want 2", n)
+	}
+	for _, tenant := range []string{DefaultTenant, "a.example.com"} {
+		if v := testutil.ToFloat64(CertExpiry.WithLabelValues(tenant)); v == 0 {
+			t.Fatalf("expiry of %s dropped by the reload", tenant)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package public
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"server_millionclient/public/protocol"
+	"syscall"
+)
+
+// 连接关闭的原因, 对应 ConnectionCloses 的 reason 标签
+const (
+	// CloseEOF 对端正常关闭
+	CloseEOF = "eof"
+	// CloseReset 对端 RST 或者写入已关闭的连接
+	CloseReset = "reset"
+	// CloseProtocol 帧头不合法, PROXY 头不合法, tls record 解密失败等
+	CloseProtocol = "protocol_error"
+	// CloseTimeout 读写超时或心跳超时被驱逐
+	CloseTimeout    = "timeout"
+	CloseWriteError = "write_error"
+	// CloseRateLimit 限速动作为 close 时超限
+	CloseRateLimit = "rate_limit"
+	// CloseShed 内存压力下被关闭
+	CloseShed = "shed"
+	// CloseAdmin 通过管理接口强制关闭, 见 Inspector
+	CloseAdmin = "admin"
+	CloseOther = "other"
+)
+
+// ErrWriteFailed 向连接写入失败, 由 WriteFrame 包装, 用于区分读写两侧的错误
+var ErrWriteFailed = errors.New("write failed")
+
+type writeError struct{ error }
+
+func (e writeError) Is(target error) bool { return target == ErrWriteFailed }
+func (e writeError) Unwrap() error        { return e.error }
+
+// WriteFrame 向 w(p 所属的连接, tls backend 为 tls.Conn)写入一个完整的帧并计数,
+// 失败时返回的错误满足 errors.Is(err, ErrWriteFailed)
+func (p *Peer) WriteFrame(w io.Writer, frame []byte) error {
+	if _, err := w.Write(frame); err != nil {
+		return writeError{err}
+	}
+	p.FrameOut(len(frame))
+	return nil
+}
+
+// FrameIn 收到一个长度为 n 的完整帧(Header + body)
+func (p *Peer) FrameIn(n int) {
+	FramesIn.Inc()
+	BytesIn.Add(float64(n))
+	p.framesIn.Add(1)
+	p.bytesIn.Add(uint64(n))
+}
+
+// FrameOut 发出一个长度为 n 的完整帧, 事件循环的 backend 在放入发送队列时调用
+func (p *Peer) FrameOut(n int) {
+	FramesOut.Inc()
+	BytesOut.Add(float64(n))
+	p.framesOut.Add(1)
+	p.bytesOut.Add(uint64(n))
+}
+
+// ClassifyClose 按导致连接关闭的错误归类, 返回 ConnectionCloses 的 reason
+func ClassifyClose(err error) string {
+	var sysErr *os.SyscallError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return CloseOther
+	case errors.Is(err, ErrRateLimited):
+		return CloseRateLimit
+	case errors.Is(err, protocol.ErrProtocol):
+		return CloseProtocol
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return CloseReset
+	case errors.Is(err, ErrWriteFailed), errors.As(err, &sysErr) && sysErr.Syscall == "write":
+		return CloseWriteError
+	case errors.Is(err, os.ErrDeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return CloseTimeout
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return CloseEOF
+	}
+	return CloseOther
+}
+
+// MarkClose 在关闭连接之前记录原因, 只有第一次生效, 返回是否生效.
+// 心跳驱逐, 内存保护等从连接之外关闭连接时, 持有连接的一方随后只能读到 EOF, 需要据此得到真正的原因
+func (p *Peer) MarkClose(reason string) bool {
+	return p.closeReason.CompareAndSwap(nil, &reason)
+}
+
+// Closing 已经由 MarkClose 标记为关闭, 连接可能还没有从 registry 中移除
+func (p *Peer) Closing() bool {
+	return p.closeReason.Load() != nil
+}
+
+// CloseReason 连接关闭的原因: MarkClose 记录的原因优先, 否则按 err 归类
+func (p *Peer) CloseReason(err error) string {
+	if reason := p.closeReason.Load(); reason != nil {
+		return *reason
+	}
+	return ClassifyClose(err)
+}
+
+// ObserveClose 已建立的连接关闭时调用, 与 ConnectionCount.Dec 成对
+func ObserveClose(peer *Peer, err error) {
+	ConnectionCloses.WithLabelValues(peer.CloseReason(err)).Inc()
+}
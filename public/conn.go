@@ -0,0 +1,128 @@
+package public
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Peer 连接的应用层状态.
+// net.Conn 类 backend 通过 Conn 持有, gnet backend 通过 gnet.Conn.Context() 持有
+type Peer struct {
+	// ID 进程内唯一的连接序号, 见 Inspector
+	ID uint64
+	// ConnectedAt 建立连接的时间
+	ConnectedAt time.Time
+	// ClientAddr 客户端地址, 经过 PROXY protocol 时为头中的原始客户端地址, 而不是负载均衡器的地址
+	ClientAddr net.Addr
+	// Identity 经过校验的客户端证书身份(mTLS), 见 TLSIdentity
+	Identity string
+	// Tenant 按 SNI 匹配到的租户(tls 证书目录中的主机名), 见 CertReloader.Tenant
+	Tenant string
+	// Protocol 协商出的 ALPN 协议, 没有协商时为空, 见 Router
+	Protocol string
+	// TLS 握手完成后的 tls 状态, 非 tls backend 为 nil
+	TLS *TLSInfo
+	// Loop 连接所属事件循环的指标: gnet 见 LoopStats, epoll backend 为 Epoll.Stats. 阻塞读取的 backend 为 nil
+	Loop     *PollerStats
+	lastSeen atomic.Int64
+	// 收发的帧数和字节数, 见 FrameIn/FrameOut
+	framesIn, framesOut atomic.Uint64
+	bytesIn, bytesOut   atomic.Uint64
+	// closeReason 见 MarkClose
+	closeReason atomic.Pointer[string]
+
+	// 限速用的令牌桶, 见 RateLimiter
+	frames tokenBucket
+	bytes  tokenBucket
+	// ResumeAt 限速(delay)时暂停读取的截止时间, 由 RateLimiter.Limit 设置
+	ResumeAt time.Time
+}
+
+var peerID atomic.Uint64
+
+func NewPeer() *Peer {
+	p := &Peer{ID: peerID.Add(1), ConnectedAt: time.Now()}
+	p.Seen()
+	return p
+}
+
+// Seen 收到对端任意帧时调用
+func (p *Peer) Seen() {
+	p.lastSeen.Store(time.Now().UnixNano())
+}
+
+// Idle 距离上次收到对端帧的时长
+func (p *Peer) Idle(now time.Time) time.Duration {
+	return now.Sub(time.Unix(0, p.lastSeen.Load()))
+}
+
+// Conn net.Conn 附带 Peer
+type Conn struct {
+	net.Conn
+	*Peer
+}
+
+func NewConn(conn net.Conn) *Conn {
+	c := &Conn{Conn: conn, Peer: NewPeer()}
+	c.ClientAddr = conn.RemoteAddr()
+	return c
+}
+
+// RemoteAddr 返回 ClientAddr, 日志等处据此看到原始客户端地址
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.ClientAddr
+}
+
+// NetConn 返回被包装的连接, 与 tls.Conn 一致, netFD 等需要底层连接的地方据此逐层解包
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Fd 底层 socket 的 fd, 与 gnet.Conn.Fd 一致. 不持有 fd 的引用, 在持有连接的 goroutine 之外使用时改用 SyscallConn
+func (c *Conn) Fd() int {
+	return netFD(c.Conn)
+}
+
+// SyscallConn 底层 socket 的 RawConn, Control 执行期间连接的 fd 不会被关闭和复用, 见 TCPInfoSampler
+func (c *Conn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := unwrapConn(c.Conn).(syscall.Conn)
+	if !ok {
+		return nil, errors.New("connection does not expose its fd")
+	}
+	return sc.SyscallConn()
+}
+
+// Shutdown 关闭读端, 持有连接的事件循环/goroutine 随后读到 EOF 并按正常流程清理.
+// 用于在其他 goroutine 中关闭连接, 避免与事件循环重复清理
+func (c *Conn) Shutdown() error {
+	if tcpConn, ok := unwrapConn(c.Conn).(*net.TCPConn); ok {
+		return tcpConn.CloseRead()
+	}
+	return c.Conn.Close()
+}
+
+// SetBuffers 设置底层 socket 的收发缓冲区大小
+func (c *Conn) SetBuffers(size int) error {
+	tcpConn, ok := unwrapConn(c.Conn).(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if err := tcpConn.SetReadBuffer(size); err != nil {
+		return err
+	}
+	return tcpConn.SetWriteBuffer(size)
+}
+
+// unwrapConn 逐层解包到最底层的连接
+func unwrapConn(conn net.Conn) net.Conn {
+	for {
+		w, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			return conn
+		}
+		conn = w.NetConn()
+	}
+}
@@ -1,11 +1,11 @@
 package public
 
 import (
-	"crypto/tls"
 	"net"
 	"reflect"
 	"sync"
 	"syscall"
+	"time"
 
 	"go.uber.org/zap"
 	"golang.org/x/sys/unix"
@@ -15,6 +15,19 @@ type Epoll struct {
 	fd          int
 	connections map[int]net.Conn
 	lock        *sync.RWMutex
+
+	// batch 在 Wait 返回到下一次 Wait 之间持有, 即事件循环处理一批连接期间持有, Detach 借此等待当前批次处理完
+	batch   sync.Mutex
+	inBatch bool
+
+	// wakeFd eventfd, Ready 通过它唤醒 Wait, 把 ready 中的连接交给事件循环
+	wakeFd    int
+	readyLock sync.Mutex
+	ready     []net.Conn
+
+	// stats 见 Instrument, batchStart 本批次事件开始处理的时间
+	stats      *PollerStats
+	batchStart time.Time
 }
 
 func MkEpoll() (*Epoll, error) {
@@ -22,13 +35,34 @@ func MkEpoll() (*Epoll, error) {
 	if err != nil {
 		return nil, err
 	}
+	wakeFd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		_ = unix.Close(fd)
+		return nil, err
+	}
+	if err = unix.EpollCtl(fd, syscall.EPOLL_CTL_ADD, wakeFd, &unix.EpollEvent{Events: unix.POLLIN, Fd: int32(wakeFd)}); err != nil {
+		_ = unix.Close(wakeFd)
+		_ = unix.Close(fd)
+		return nil, err
+	}
 	return &Epoll{
 		fd:          fd,
 		lock:        &sync.RWMutex{},
 		connections: make(map[int]net.Conn),
+		wakeFd:      wakeFd,
 	}, nil
 }
 
+// Instrument 开启该 poller 的指标, poller 为标签值, 需要在 Add 和 Wait 之前调用
+func (e *Epoll) Instrument(poller string) {
+	e.stats = newPollerStats(poller)
+}
+
+// Stats Instrument 创建的指标, 没有开启时为 nil. 注册到该 poller 的连接保存在 Peer.Loop 中
+func (e *Epoll) Stats() *PollerStats {
+	return e.stats
+}
+
 func (e *Epoll) Add(conn net.Conn) error {
 	fd := netFD(conn)
 	err := unix.EpollCtl(e.fd, syscall.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Events: unix.POLLIN | unix.POLLHUP, Fd: int32(fd)})
@@ -38,6 +72,7 @@ func (e *Epoll) Add(conn net.Conn) error {
 	e.lock.Lock()
 	defer e.lock.Unlock()
 	e.connections[fd] = conn
+	e.setFds()
 	if len(e.connections)%100 == 0 {
 		Logger.Debug("", zap.Int("connections", len(e.connections)))
 	}
@@ -53,38 +88,122 @@ func (e *Epoll) Remove(conn net.Conn) error {
 	e.lock.Lock()
 	defer e.lock.Unlock()
 	delete(e.connections, fd)
+	e.setFds()
 	if len(e.connections)%100 == 0 {
 		Logger.Debug("", zap.Int("connections", len(e.connections)))
 	}
 	return nil
 }
 
+// Mute 停止监听连接的可读事件, 直到 Remove. 连接仍可以通过 Ready 交给事件循环
+func (e *Epoll) Mute(conn net.Conn) error {
+	fd := netFD(conn)
+	return unix.EpollCtl(e.fd, syscall.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd)})
+}
+
+// Pause 暂停监听连接的可读事件, d 之后恢复. 用于限速时推迟读取
+func (e *Epoll) Pause(conn net.Conn, d time.Duration) error {
+	if err := e.Mute(conn); err != nil {
+		return err
+	}
+	fd := netFD(conn)
+	time.AfterFunc(d, func() {
+		e.lock.RLock()
+		defer e.lock.RUnlock()
+		// 期间连接可能已关闭, fd 甚至被新连接复用, 只恢复仍是同一个连接的 fd
+		if e.connections[fd] != conn {
+			return
+		}
+		err := unix.EpollCtl(e.fd, syscall.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Events: unix.POLLIN | unix.POLLHUP, Fd: int32(fd)})
+		if err != nil {
+			Logger.Debug("epoll resume failed", zap.Int("fd", fd), zap.Error(err))
+		}
+	})
+	return nil
+}
+
+// Ready 让 conn 出现在下一次 Wait 的结果中, 即使它没有可读事件.
+// 用于其他 goroutine 把连接交还给事件循环处理, 如握手完成后
+func (e *Epoll) Ready(conn net.Conn) error {
+	e.readyLock.Lock()
+	e.ready = append(e.ready, conn)
+	e.readyLock.Unlock()
+	var one [8]byte
+	one[7] = 1
+	if _, err := unix.Write(e.wakeFd, one[:]); err != nil && err != unix.EAGAIN {
+		return err
+	}
+	return nil
+}
+
+// Wait 只能由一个事件循环 goroutine 调用
 func (e *Epoll) Wait() ([]net.Conn, error) {
+	if e.inBatch {
+		e.inBatch = false
+		e.batch.Unlock()
+	}
 	events := make([]unix.EpollEvent, 100)
+	start := time.Now()
+	if e.stats != nil && !e.batchStart.IsZero() {
+		e.stats.Handled(start.Sub(e.batchStart))
+	}
 	n, err := unix.EpollWait(e.fd, events, -1)
+	if e.stats != nil {
+		e.batchStart = time.Now()
+		e.stats.Waited(max(n, 0), e.batchStart.Sub(start))
+	}
 	if err != nil {
 		return nil, err
 	}
+	e.batch.Lock()
+	e.inBatch = true
 	e.lock.RLock()
 	defer e.lock.RUnlock()
 	var connections []net.Conn
 	for i := 0; i < n; i++ {
+		if int(events[i].Fd) == e.wakeFd {
+			var counter [8]byte
+			_, _ = unix.Read(e.wakeFd, counter[:])
+			e.readyLock.Lock()
+			connections = append(connections, e.ready...)
+			e.ready = nil
+			e.readyLock.Unlock()
+			continue
+		}
 		conn := e.connections[int(events[i].Fd)]
 		connections = append(connections, conn)
 	}
 	return connections, nil
 }
 
-func netFD(conn net.Conn) int {
-	//connVal := reflect.Indirect(reflect.ValueOf(conn)).FieldByName("conn").Elem()
-	//tcpConn := reflect.Indirect(connVal).FieldByName("conn")'
-	var tcpConn reflect.Value
-	if _, ok := conn.(*tls.Conn); ok {
-		connVal := reflect.Indirect(reflect.ValueOf(conn)).FieldByName("conn").Elem()
-		tcpConn = reflect.Indirect(connVal).FieldByName("conn")
-	} else {
-		tcpConn = reflect.Indirect(reflect.ValueOf(conn)).FieldByName("conn")
+// Detach 等待当前批次处理完, 然后把所有连接移出 epoll 并返回, 连接本身不会被关闭
+func (e *Epoll) Detach() []net.Conn {
+	e.batch.Lock()
+	defer e.batch.Unlock()
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	connections := make([]net.Conn, 0, len(e.connections))
+	for fd, conn := range e.connections {
+		if err := unix.EpollCtl(e.fd, syscall.EPOLL_CTL_DEL, fd, nil); err != nil {
+			Logger.Error("epoll ctl del failed", zap.Int("fd", fd), zap.Error(err))
+		}
+		connections = append(connections, conn)
 	}
+	clear(e.connections)
+	e.setFds()
+	return connections
+}
+
+// setFds 持有 lock 时调用
+func (e *Epoll) setFds() {
+	if e.stats != nil {
+		e.stats.SetFds(len(e.connections))
+	}
+}
+
+func netFD(conn net.Conn) int {
+	// tls.Conn/Conn 等包装先解包到 *net.TCPConn
+	tcpConn := reflect.Indirect(reflect.ValueOf(unwrapConn(conn))).FieldByName("conn")
 	fdVal := tcpConn.FieldByName("fd")
 	pfdVal := reflect.Indirect(fdVal).FieldByName("pfd")
 	return int(pfdVal.FieldByName("Sysfd").Int())
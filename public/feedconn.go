@@ -0,0 +1,222 @@
+package public
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// recordHeaderLen tls 记录头: type(1) + version(2) + length(2)
+	recordHeaderLen = 5
+	// recordTypeHandshake 握手记录的 type
+	recordTypeHandshake = 0x16
+)
+
+// FeedConn 由事件循环喂数据的 net.Conn, 作为 crypto/tls 的底层连接:
+// 事件循环读到的密文通过 Feed 送入内存缓冲区, tls 读取时消费缓冲区, 缓冲区为空时等待下一次 Feed,
+// 而不是阻塞在 socket 上. 写直接写到原始连接.
+// Direct 之后缓冲区读完即直接从原始连接读取, 用于握手结束后回到普通的读写方式
+type FeedConn struct {
+	net.Conn
+
+	lock     sync.Mutex
+	buf      []byte
+	err      error
+	direct   bool
+	deadline time.Time
+	// onWait Read 因缓冲区为空而等待之前调用, 见 OnWait
+	onWait func()
+	// ready 缓冲区、err 或 direct 变化时通知等待中的 Read
+	ready chan struct{}
+}
+
+func NewFeedConn(conn net.Conn) *FeedConn {
+	return &FeedConn{Conn: conn, ready: make(chan struct{}, 1)}
+}
+
+// NetConn 返回原始连接, netFD 据此解包
+func (c *FeedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// Feed 追加从 socket 读到的数据, b 会被复制
+func (c *FeedConn) Feed(b []byte) {
+	c.lock.Lock()
+	c.buf = append(c.buf, b...)
+	c.lock.Unlock()
+	c.notify()
+}
+
+// Fail 让缓冲区读完之后的 Read 返回 err, 如对端关闭时的 io.EOF
+func (c *FeedConn) Fail(err error) {
+	c.lock.Lock()
+	if c.err == nil {
+		c.err = err
+	}
+	c.lock.Unlock()
+	c.notify()
+}
+
+// Direct 切换为直接从原始连接读取
+func (c *FeedConn) Direct() {
+	c.lock.Lock()
+	c.direct = true
+	c.lock.Unlock()
+	c.notify()
+}
+
+// OnWait 设置 Read 等待下一次 Feed 之前的回调, 在 Read 的 goroutine 中调用, 握手池据此让出 worker. fn 为 nil 时清除
+func (c *FeedConn) OnWait(fn func()) {
+	c.lock.Lock()
+	c.onWait = fn
+	c.lock.Unlock()
+}
+
+// Fill 不阻塞地读出原始 socket 上当前所有可读的数据放入缓冲区, 由 epoll 事件循环在可读事件时调用.
+// 对端关闭时返回 io.EOF, 此前读到的数据仍会放入缓冲区
+func (c *FeedConn) Fill() (int, error) {
+	sc, ok := unwrapConn(c.Conn).(syscall.Conn)
+	if !ok {
+		return 0, errors.New("connection does not expose its fd")
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var buf [4096]byte
+	var total int
+	var readErr error
+	// 回调返回 true 表示不等待 runtime netpoller 的可读通知
+	err = rc.Read(func(fd uintptr) bool {
+		for {
+			n, err := unix.Read(int(fd), buf[:])
+			switch {
+			case err == unix.EINTR:
+				continue
+			case err == unix.EAGAIN:
+			case err != nil:
+				readErr = err
+			case n == 0:
+				readErr = io.EOF
+			default:
+				c.Feed(buf[:n])
+				total += n
+				continue
+			}
+			return true
+		}
+	})
+	if err != nil {
+		return total, err
+	}
+	return total, readErr
+}
+
+// Buffered 返回缓冲区中尚未被读取的字节数
+func (c *FeedConn) Buffered() int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return len(c.buf)
+}
+
+// pending 返回缓冲区中数据的副本, 以及是否已经 Direct, 用于交接
+func (c *FeedConn) pending() ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return bytes.Clone(c.buf), c.direct
+}
+
+// RecordReady 缓冲区中第一个 tls 记录已经完整, 或者根本不是握手记录(交给 crypto/tls 报错).
+// 握手前据此判断 ClientHello 是否到齐
+func (c *FeedConn) RecordReady() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.buf) > 0 && c.buf[0] != recordTypeHandshake {
+		return true
+	}
+	if len(c.buf) < recordHeaderLen {
+		return false
+	}
+	return len(c.buf) >= recordHeaderLen+(int(c.buf[3])<<8|int(c.buf[4]))
+}
+
+func (c *FeedConn) Read(b []byte) (int, error) {
+	for {
+		c.lock.Lock()
+		if len(c.buf) > 0 {
+			n := copy(b, c.buf)
+			c.buf = c.buf[n:]
+			if len(c.buf) == 0 {
+				c.buf = nil
+			}
+			c.lock.Unlock()
+			return n, nil
+		}
+		direct, err, deadline, onWait := c.direct, c.err, c.deadline, c.onWait
+		c.lock.Unlock()
+		if direct {
+			return c.Conn.Read(b)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if onWait != nil {
+			onWait()
+		}
+		if err := c.wait(deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *FeedConn) wait(deadline time.Time) error {
+	if deadline.IsZero() {
+		<-c.ready
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-c.ready:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (c *FeedConn) notify() {
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+// SetDeadline 同时作用于缓冲区的等待和原始连接
+func (c *FeedConn) SetDeadline(t time.Time) error {
+	c.setReadDeadline(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *FeedConn) SetReadDeadline(t time.Time) error {
+	c.setReadDeadline(t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *FeedConn) setReadDeadline(t time.Time) {
+	c.lock.Lock()
+	c.deadline = t
+	c.lock.Unlock()
+	c.notify()
+}
@@ -0,0 +1,204 @@
+package public
+
+import (
+	"context"
+	"flag"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CommonFlags 各个服务端共用的命令行参数: 监听地址, 日志, 管理接口, watchdog, TCP_INFO 采样, OTLP, 心跳, 限流, 准入和内存保护.
+// 各 backend 只在自己的 main 中定义 TLS, 交接等特有的参数
+type CommonFlags struct {
+	Addr          string
+	ProxyProtocol bool
+	AdminAddr     string
+	AdminToken    string
+	Pprof         bool
+
+	verbose           bool
+	logFormat         string
+	logFile           string
+	logMaxSize        int
+	logMaxBackups     int
+	logMaxAge         int
+	logSampleInitial  int
+	logSampleAfter    int
+	profileDir        string
+	profileRSS        uint64
+	profileGoroutines int
+	profileGCPause    time.Duration
+	profileP99        time.Duration
+	profileCooldown   time.Duration
+	profileKeep       int
+	tcpInfoInterval   time.Duration
+	tcpInfoBatch      int
+	otlpEndpoint      string
+	otlpInterval      time.Duration
+	traceRatio        float64
+	heartbeat         string
+	heartbeatInterval time.Duration
+	heartbeatMiss     int
+	rateConnFrames    float64
+	rateConnBytes     float64
+	rateGlobalFrames  float64
+	rateGlobalBytes   float64
+	rateAction        string
+	maxConns          int
+	acceptRate        float64
+	memLimit          uint64
+	memThresholds     string
+	memShed           string
+}
+
+// NewCommonFlags 把共用参数注册到 flag.CommandLine, 需要在 flag.Parse 之前调用
+func NewCommonFlags() *CommonFlags {
+	f := &CommonFlags{}
+	flag.StringVar(&f.Addr, "addr", ":8000", "server addr")
+	flag.BoolVar(&f.verbose, "verbose", false, "verbose")
+	flag.StringVar(&f.logFormat, "log-format", "console", "log format: console or json")
+	flag.StringVar(&f.logFile, "log-file", "", "log file rotated by size, empty to log to stderr")
+	flag.IntVar(&f.logMaxSize, "log-max-size", 100, "max size in MB of the log file before it is rotated")
+	flag.IntVar(&f.logMaxBackups, "log-max-backups", 10, "max number of rotated log files to keep, 0 to keep all")
+	flag.IntVar(&f.logMaxAge, "log-max-age", 0, "max days to keep rotated log files, 0 to keep them regardless of age")
+	flag.IntVar(&f.logSampleInitial, "log-sample-initial", 2, "log the first N entries with the same level and message every second, 0 to disable sampling")
+	flag.IntVar(&f.logSampleAfter, "log-sample-thereafter", 50, "after -log-sample-initial, log every Nth entry with the same level and message in that second")
+	flag.BoolVar(&f.ProxyProtocol, "proxy-protocol", false, "expect a HAProxy PROXY protocol v1/v2 header on every connection, for servers behind an L4 load balancer")
+	flag.StringVar(&f.AdminAddr, "admin-addr", "127.0.0.1:8112", "admin http server addr for /metrics, /healthz, /readyz, /connections and /debug/pprof, empty to disable")
+	flag.StringVar(&f.AdminToken, "admin-token", "", "bearer token required by DELETE /connections/{id} and PUT /log/level on the admin server, empty to disable them")
+	flag.BoolVar(&f.Pprof, "pprof", false, "expose /debug/pprof on the admin server")
+	flag.StringVar(&f.profileDir, "profile-dir", "", "directory for watchdog profile snapshots, empty to disable")
+	flag.Uint64Var(&f.profileRSS, "profile-rss", 0, "capture profiles when RSS reaches this many bytes, 0 to disable")
+	flag.IntVar(&f.profileGoroutines, "profile-goroutines", 0, "capture profiles when the goroutine count reaches this, 0 to disable")
+	flag.DurationVar(&f.profileGCPause, "profile-gc-pause", 0, "capture profiles when a GC pause reaches this, 0 to disable")
+	flag.DurationVar(&f.profileP99, "profile-p99", 0, "capture profiles when the p99 message latency reaches this, 0 to disable")
+	flag.DurationVar(&f.profileCooldown, "profile-cooldown", 10*time.Minute, "minimum interval between two profile snapshots")
+	flag.IntVar(&f.profileKeep, "profile-keep", 10, "number of profile snapshots to keep, older ones are removed")
+	flag.DurationVar(&f.tcpInfoInterval, "tcp-info-interval", 10*time.Second, "interval to sample TCP_INFO of a rotating subset of connections, 0 to disable")
+	flag.IntVar(&f.tcpInfoBatch, "tcp-info-batch", 1000, "number of connections to sample TCP_INFO from every -tcp-info-interval")
+	flag.StringVar(&f.otlpEndpoint, "otlp-endpoint", "", "OTLP/HTTP collector url to export metrics and traces to, e.g. http://127.0.0.1:4318, empty to disable")
+	flag.DurationVar(&f.otlpInterval, "otlp-interval", 15*time.Second, "interval to export metrics over OTLP")
+	flag.Float64Var(&f.traceRatio, "trace-ratio", 0.01, "fraction of frames to trace when the client sent no trace context")
+	flag.StringVar(&f.heartbeat, "heartbeat", "off", "heartbeat mode: off, client (client pings) or server (server pings)")
+	flag.DurationVar(&f.heartbeatInterval, "heartbeat-interval", 30*time.Second, "heartbeat interval")
+	flag.IntVar(&f.heartbeatMiss, "heartbeat-miss", 3, "evict a peer after this many missed heartbeat intervals")
+	flag.Float64Var(&f.rateConnFrames, "rate-conn-frames", 0, "per-connection frames/sec limit, 0 for unlimited")
+	flag.Float64Var(&f.rateConnBytes, "rate-conn-bytes", 0, "per-connection bytes/sec limit, 0 for unlimited")
+	flag.Float64Var(&f.rateGlobalFrames, "rate-global-frames", 0, "aggregate frames/sec limit of all connections, 0 for unlimited")
+	flag.Float64Var(&f.rateGlobalBytes, "rate-global-bytes", 0, "aggregate bytes/sec limit of all connections, 0 for unlimited")
+	flag.StringVar(&f.rateAction, "rate-action", "delay", "action on rate limit violation: delay, drop or close")
+	flag.IntVar(&f.maxConns, "max-conns", 0, "max concurrent connections, 0 for unlimited")
+	flag.Float64Var(&f.acceptRate, "accept-rate", 0, "max accepted connections/sec, 0 for unlimited")
+	flag.Uint64Var(&f.memLimit, "mem-limit", 0, "memory limit in bytes for load shedding, 0 to detect from cgroup and GOMEMLIMIT")
+	flag.StringVar(&f.memThresholds, "mem-thresholds", "0.7,0.8,0.9", "memory usage ratios to stop accepting, shrink buffers and shed connections")
+	flag.StringVar(&f.memShed, "mem-shed", "newest", "connections to close first under memory pressure: newest or idlest")
+	return f
+}
+
+// Common CommonFlags.Setup 根据共用参数创建的组件
+type Common struct {
+	flags     *CommonFlags
+	Limiter   *RateLimiter
+	Admission *Admission
+	hbMode    HeartbeatMode
+	memTh     [3]float64
+	shed      ShedPolicy
+}
+
+// Setup 在 flag.Parse 之后调用: 初始化日志, 指标, OTel 和 fd 上限, 创建限流器和准入控制, 参数错误时直接退出.
+// ctx 为 main 的信号 context, 收到信号时立即导出缓冲的 span 和指标; 返回的 shutdown 在 drain 之后、进程退出前导出剩余的部分
+func (f *CommonFlags) Setup(ctx context.Context, service string) (c *Common, shutdown func()) {
+	if err := InitLoggerConfig(LogConfig{
+		Debug:            f.verbose,
+		Format:           f.logFormat,
+		File:             f.logFile,
+		MaxSize:          f.logMaxSize,
+		MaxBackups:       f.logMaxBackups,
+		MaxAge:           f.logMaxAge,
+		SampleInitial:    f.logSampleInitial,
+		SampleThereafter: f.logSampleAfter,
+	}); err != nil {
+		Logger.Fatal("init logger failed", zap.Error(err))
+	}
+	InitMetrics(service)
+	shutdownOTel, err := InitOTel(OTelConfig{
+		Endpoint: f.otlpEndpoint,
+		Service:  service,
+		Metrics:  true,
+		Interval: f.otlpInterval,
+		Ratio:    f.traceRatio,
+	})
+	if err != nil {
+		Logger.Fatal("init otel failed", zap.Error(err))
+	}
+	flushed := make(chan struct{})
+	stopFlush := context.AfterFunc(ctx, func() {
+		FlushOTel()
+		close(flushed)
+	})
+	SetLimit()
+
+	c = &Common{flags: f}
+	rateAct, err := ParseRateLimitAction(f.rateAction)
+	if err != nil {
+		Logger.Fatal("parse rate limit action failed", zap.Error(err))
+	}
+	c.Limiter = NewRateLimiter(RateLimitConfig{
+		ConnFrames:   f.rateConnFrames,
+		ConnBytes:    f.rateConnBytes,
+		GlobalFrames: f.rateGlobalFrames,
+		GlobalBytes:  f.rateGlobalBytes,
+		Action:       rateAct,
+	})
+	c.Admission = NewAdmission(f.maxConns, f.acceptRate)
+	if c.memTh, err = ParseMemoryThresholds(f.memThresholds); err != nil {
+		Logger.Fatal("parse memory thresholds failed", zap.Error(err))
+	}
+	if c.shed, err = ParseShedPolicy(f.memShed); err != nil {
+		Logger.Fatal("parse shed policy failed", zap.Error(err))
+	}
+	if c.hbMode, err = ParseHeartbeatMode(f.heartbeat); err != nil {
+		Logger.Fatal("parse heartbeat mode failed", zap.Error(err))
+	}
+	return c, func() {
+		// 没有 drain 时 shutdown 可能紧接着信号, 等正在进行的 flush 结束
+		if !stopFlush() {
+			<-flushed
+		}
+		shutdownOTel()
+	}
+}
+
+// RunMonitors 在后台启动 registry 的心跳检测, 内存保护, watchdog 和 TCP_INFO 采样.
+// ping 把 ping 帧写给连接, shrink 设置连接的 socket 缓冲区大小, close 关闭心跳超时或内存压力下被挑中的连接
+func RunMonitors[C interface {
+	comparable
+	Fd() int
+}](c *Common, registry *Registry[C], ping func(C, []byte) error, shrink func(C, int), close func(C)) {
+	f := c.flags
+	go NewHeartbeat(registry, c.hbMode, f.heartbeatInterval, f.heartbeatMiss, ping, close).Run(context.Background())
+	go NewMemoryGuard(registry, f.memLimit, c.memTh, c.shed, shrink, close).Run(context.Background())
+	go NewWatchdog(WatchdogConfig{
+		Dir:        f.profileDir,
+		RSS:        f.profileRSS,
+		Goroutines: f.profileGoroutines,
+		GCPause:    f.profileGCPause,
+		P99Latency: f.profileP99,
+		Cooldown:   f.profileCooldown,
+		Keep:       f.profileKeep,
+	}).Run(context.Background())
+	go NewTCPInfoSampler(registry, f.tcpInfoInterval, f.tcpInfoBatch).Run(context.Background())
+}
+
+// StartAdmin 在 -admin-addr 上启动管理接口, /connections 查看和关闭 registry 中的连接.
+// inherited 为交接得到的管理端口 listener, 没有时传 nil. 启动失败时直接退出
+func StartAdmin[C comparable](c *Common, registry *Registry[C], close func(C), inherited net.Listener) *Admin {
+	admin := NewAdmin(c.flags.Pprof, c.flags.AdminToken)
+	admin.HandleConnections(NewInspector(registry, close))
+	if err := admin.Start(c.flags.AdminAddr, inherited); err != nil {
+		Logger.Fatal("start admin server failed", zap.Error(err))
+	}
+	return admin
+}
@@ -0,0 +1,445 @@
+package public
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// handoffBatch 单条 SCM_RIGHTS 消息携带的 fd 数, 内核上限 SCM_MAX_FD = 253
+	handoffBatch = 250
+	// handoffHeaderLen header: listener 数 + 管理服务 listener 数(0 或 1) + 连接数 + 连接状态消息数
+	handoffHeaderLen = 16
+	// handoffMaxMsg 连接状态消息的最大长度, 小于 unixpacket 的发送缓冲区
+	handoffMaxMsg = 64 << 10
+	// handoffTimeout 从新进程连上到收到 ack 的最长时间
+	handoffTimeout = 30 * time.Second
+	// drainPollInterval Drain 检查剩余连接数的间隔
+	drainPollInterval = 200 * time.Millisecond
+)
+
+// Inheritance 新旧进程之间交接的 fd.
+// 交出时 Conns 为事件循环中的连接(*Conn, 或者还没有读完 PROXY 头的 *FeedConn).
+// Inherit 返回的 Conns 与之对应: *Conn 带有旧进程中的 ClientAddr, *FeedConn 还需要读取 PROXY 头;
+// 旧进程已经读出但还没有处理的数据在 FeedConn 的缓冲区中, 见 HasBuffered.
+// Admin 为管理服务的 listener, 见 Admin.Start
+type Inheritance struct {
+	Listeners []net.Listener
+	Admin     net.Listener
+	Conns     []net.Conn
+}
+
+// Inherit 连接旧进程的 handoff socket, 接收其 listener 及连接 fd.
+// path 为空或者没有旧进程在监听时返回空的 Inheritance.
+func Inherit(path string) (*Inheritance, error) {
+	inh := &Inheritance{}
+	if path == "" {
+		return inh, nil
+	}
+	conn, err := net.Dial("unixpacket", path)
+	if err != nil {
+		if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+			return inh, nil
+		}
+		return nil, fmt.Errorf("dial handoff socket failed: %w", err)
+	}
+	defer conn.Close()
+	uc := conn.(*net.UnixConn)
+
+	header := make([]byte, handoffHeaderLen)
+	if _, err := uc.Read(header); err != nil {
+		return nil, fmt.Errorf("read handoff header failed: %w", err)
+	}
+	// fds 依次为 listener, 管理服务 listener, 连接
+	lnNum := int(binary.BigEndian.Uint32(header[:4]))
+	adminNum := int(binary.BigEndian.Uint32(header[4:8]))
+	connNum := int(binary.BigEndian.Uint32(header[8:12]))
+	stateNum := int(binary.BigEndian.Uint32(header[12:]))
+	lnNum += adminNum
+
+	fds := make([]int, 0, lnNum+connNum)
+	buf := make([]byte, 1)
+	oob := make([]byte, unix.CmsgSpace(handoffBatch*4))
+	for len(fds) < lnNum+connNum {
+		_, oobn, _, _, err := uc.ReadMsgUnix(buf, oob)
+		if err != nil {
+			closeFds(fds)
+			return nil, fmt.Errorf("read handoff fds failed: %w", err)
+		}
+		received, err := parseRights(oob[:oobn])
+		if err != nil {
+			closeFds(fds)
+			return nil, err
+		}
+		fds = append(fds, received...)
+	}
+
+	// fds 之后是连接状态, 只有与默认状态不同的连接才有
+	states := make(map[int]*connState, stateNum)
+	msg := make([]byte, handoffMaxMsg)
+	for range stateNum {
+		n, err := uc.Read(msg)
+		if err != nil {
+			closeFds(fds)
+			return nil, fmt.Errorf("read handoff connection state failed: %w", err)
+		}
+		index, state, err := decodeConnState(msg[:n])
+		if err != nil {
+			closeFds(fds)
+			return nil, err
+		}
+		// 较多的缓冲数据分成多条消息
+		if prev := states[index]; prev != nil {
+			prev.buffered = append(prev.buffered, state.buffered...)
+			continue
+		}
+		states[index] = state
+	}
+
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "inherited")
+		if i < lnNum {
+			ln, err := net.FileListener(f)
+			_ = f.Close()
+			if err != nil {
+				Logger.Error("inherit listener failed", zap.Error(err))
+				continue
+			}
+			if i < lnNum-adminNum {
+				inh.Listeners = append(inh.Listeners, ln)
+			} else {
+				inh.Admin = ln
+			}
+		} else {
+			c, err := net.FileConn(f)
+			_ = f.Close()
+			if err != nil {
+				Logger.Debug("inherit connection failed", zap.Error(err))
+				continue
+			}
+			inh.Conns = append(inh.Conns, states[i-lnNum].restore(c))
+		}
+	}
+
+	// ack, 旧进程收到后才会关闭自己持有的 fd 并退出
+	if _, err := uc.Write([]byte{1}); err != nil {
+		return nil, fmt.Errorf("write handoff ack failed: %w", err)
+	}
+	Logger.Info("inherited from old process",
+		zap.Int("listeners", len(inh.Listeners)), zap.Bool("admin", inh.Admin != nil), zap.Int("connections", len(inh.Conns)))
+	return inh, nil
+}
+
+// ServeHandoff 在 path 上等待新进程接管, 新进程连上后调用 export 收集需要交接的 fd,
+// 交接成功(收到 ack)后返回 nil, 调用方随后应当退出.
+// export 返回的 listener/连接在交接成功后会被关闭, 此时它们已经不能再被当前进程使用.
+// 新进程在 ack 之前退出或者超时时交接失败, listener 和连接都保持打开, restore 把 export 取出的连接交还给当前进程,
+// 然后继续等待下一个新进程. restore 可以为 nil
+func ServeHandoff(path string, export func() *Inheritance, restore func(*Inheritance)) error {
+	_ = os.Remove(path)
+	ln, err := net.Listen("unixpacket", path)
+	if err != nil {
+		return fmt.Errorf("listen handoff socket failed: %w", err)
+	}
+	// 新进程会在同一路径上重新监听, 关闭时不能把它的 socket 文件删掉
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	defer ln.Close()
+	Logger.Info("waiting for handoff", zap.String("path", path))
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return fmt.Errorf("accept handoff failed: %w", err)
+		}
+		inh := export()
+		err = handoff(conn.(*net.UnixConn), inh)
+		_ = conn.Close()
+		if err == nil {
+			inh.close()
+			return nil
+		}
+		Logger.Error("handoff failed, keep serving", zap.Error(err))
+		if restore != nil {
+			restore(inh)
+		}
+	}
+}
+
+// close 交接成功后关闭当前进程持有的 fd, 新进程持有它们的副本
+func (inh *Inheritance) close() {
+	for _, ln := range inh.Listeners {
+		_ = ln.Close()
+	}
+	if inh.Admin != nil {
+		_ = inh.Admin.Close()
+	}
+	for _, c := range inh.Conns {
+		_ = c.Close()
+	}
+}
+
+// handoff 把 inh 的 fd 副本发给新进程并等待 ack, 失败时 inh 中的 fd 保持打开
+func handoff(uc *net.UnixConn, inh *Inheritance) error {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	// 新进程卡住时不能让连接一直停在 export 取出的状态
+	if err := uc.SetDeadline(time.Now().Add(handoffTimeout)); err != nil {
+		return fmt.Errorf("set deadline failed: %w", err)
+	}
+
+	listeners := inh.Listeners
+	adminNum := 0
+	if inh.Admin != nil {
+		listeners = append(slices.Clip(listeners), inh.Admin)
+		adminNum = 1
+	}
+	for _, ln := range listeners {
+		fl, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("unsupported listener type %T", ln)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return fmt.Errorf("dup listener failed: %w", err)
+		}
+		files = append(files, f)
+	}
+	lnNum := len(files)
+	var states [][]byte
+	for _, c := range inh.Conns {
+		fc, ok := unwrapConn(c).(interface{ File() (*os.File, error) })
+		if !ok {
+			continue
+		}
+		f, err := fc.File()
+		if err != nil {
+			Logger.Debug("dup connection failed", zap.Error(err))
+			continue
+		}
+		if state := exportConnState(c); state != nil {
+			states = append(states, state.encode(len(files)-lnNum)...)
+		}
+		files = append(files, f)
+	}
+
+	header := make([]byte, handoffHeaderLen)
+	binary.BigEndian.PutUint32(header[:4], uint32(lnNum-adminNum))
+	binary.BigEndian.PutUint32(header[4:8], uint32(adminNum))
+	binary.BigEndian.PutUint32(header[8:12], uint32(len(files)-lnNum))
+	binary.BigEndian.PutUint32(header[12:], uint32(len(states)))
+	if _, err := uc.Write(header); err != nil {
+		return fmt.Errorf("write header failed: %w", err)
+	}
+	for start := 0; start < len(files); start += handoffBatch {
+		end := min(start+handoffBatch, len(files))
+		fds := make([]int, 0, end-start)
+		for _, f := range files[start:end] {
+			fd, err := fileFd(f)
+			if err != nil {
+				return fmt.Errorf("get fd failed: %w", err)
+			}
+			fds = append(fds, fd)
+		}
+		if _, _, err := uc.WriteMsgUnix([]byte{0}, unix.UnixRights(fds...), nil); err != nil {
+			return fmt.Errorf("write fds failed: %w", err)
+		}
+	}
+	for _, state := range states {
+		if _, err := uc.Write(state); err != nil {
+			return fmt.Errorf("write connection state failed: %w", err)
+		}
+	}
+
+	ack := make([]byte, 1)
+	if _, err := uc.Read(ack); err != nil {
+		return fmt.Errorf("read ack failed: %w", err)
+	}
+	Logger.Info("handed off to new process",
+		zap.Int("listeners", lnNum-adminNum), zap.Bool("admin", adminNum > 0), zap.Int("connections", len(files)-lnNum))
+	return nil
+}
+
+// fileFd 返回 dup 出来的 fd. 不能用 f.Fd(): 它把 fd 设为阻塞模式, 而阻塞模式与原 listener/连接共享,
+// 交接失败后当前进程还要继续使用它们
+func fileFd(f *os.File) (int, error) {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var fd int
+	if err := rc.Control(func(s uintptr) { fd = int(s) }); err != nil {
+		return 0, err
+	}
+	return fd, nil
+}
+
+// connState 连接在旧进程中的状态, 随 fd 一起交给新进程
+type connState struct {
+	// clientAddr PROXY 头中的客户端地址, 新进程不会再收到这个头
+	clientAddr net.Addr
+	// proxyPending 还没有读完 PROXY 头, buffered 为已经读到的部分
+	proxyPending bool
+	// buffered 已经从 socket 读出但还没有处理的数据, socket 上不会再出现
+	buffered []byte
+}
+
+const connStateProxyPending = 1
+
+// exportConnState 连接与默认状态相同时返回 nil
+func exportConnState(c net.Conn) *connState {
+	state := &connState{}
+	var feed *FeedConn
+	switch conn := c.(type) {
+	case *Conn:
+		if conn.ClientAddr != nil && conn.ClientAddr.String() != unwrapConn(conn).RemoteAddr().String() {
+			state.clientAddr = conn.ClientAddr
+		}
+		feed, _ = conn.Conn.(*FeedConn)
+	case *FeedConn:
+		feed = conn
+	}
+	if feed != nil {
+		var direct bool
+		state.buffered, direct = feed.pending()
+		state.proxyPending = c == net.Conn(feed) && !direct
+	}
+	if state.clientAddr == nil && !state.proxyPending && len(state.buffered) == 0 {
+		return nil
+	}
+	return state
+}
+
+// restore 在新进程中还原连接, state 为 nil 时是默认状态
+func (s *connState) restore(c net.Conn) net.Conn {
+	if s == nil {
+		return NewConn(c)
+	}
+	var feed *FeedConn
+	if s.proxyPending || len(s.buffered) > 0 {
+		feed = NewFeedConn(c)
+		feed.Feed(s.buffered)
+	}
+	if s.proxyPending {
+		return feed
+	}
+	if feed != nil {
+		feed.Direct()
+		c = feed
+	}
+	conn := NewConn(c)
+	if s.clientAddr != nil {
+		conn.ClientAddr = s.clientAddr
+	}
+	return conn
+}
+
+// encode 每条消息为: 连接在交接的连接中的序号(4) + flags(1) + 客户端地址长度(2) + 客户端地址 + 缓冲数据.
+// 缓冲数据超过单条消息的长度时分成多条, 后续消息的地址为空
+func (s *connState) encode(index int) [][]byte {
+	var addr string
+	if s.clientAddr != nil {
+		addr = s.clientAddr.String()
+	}
+	var flags byte
+	if s.proxyPending {
+		flags |= connStateProxyPending
+	}
+	var msgs [][]byte
+	data := s.buffered
+	for first := true; first || len(data) > 0; first = false {
+		b := binary.BigEndian.AppendUint32(nil, uint32(index))
+		b = append(b, flags)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(addr)))
+		b = append(b, addr...)
+		n := min(len(data), handoffMaxMsg-len(b))
+		msgs = append(msgs, append(b, data[:n]...))
+		data, addr = data[n:], ""
+	}
+	return msgs
+}
+
+func decodeConnState(b []byte) (int, *connState, error) {
+	if len(b) < 7 || len(b) < 7+int(binary.BigEndian.Uint16(b[5:7])) {
+		return 0, nil, fmt.Errorf("short handoff connection state: %d", len(b))
+	}
+	index := int(binary.BigEndian.Uint32(b[:4]))
+	state := &connState{proxyPending: b[4]&connStateProxyPending != 0}
+	addrEnd := 7 + int(binary.BigEndian.Uint16(b[5:7]))
+	if addrEnd > 7 {
+		addr, err := net.ResolveTCPAddr("tcp", string(b[7:addrEnd]))
+		if err != nil {
+			return 0, nil, fmt.Errorf("illegal handoff client address: %w", err)
+		}
+		state.clientAddr = addr
+	}
+	state.buffered = bytes.Clone(b[addrEnd:])
+	return index, state, nil
+}
+
+// HasBuffered 连接的缓冲区中有交接前已经读出的数据. 这些数据不会再触发可读事件,
+// 加入 epoll 之后需要通过 Epoll.Ready 交给事件循环处理
+func HasBuffered(conn net.Conn) bool {
+	if c, ok := conn.(*Conn); ok {
+		conn = c.Conn
+	}
+	feed, ok := conn.(*FeedConn)
+	return ok && feed.Buffered() > 0
+}
+
+// Drain 交接完成后调用: listener 已经交给新进程, 等待留在当前进程的连接由客户端关闭, 最多等待 timeout.
+// 返回后进程退出, 仍未关闭的连接随之断开
+func Drain[C comparable](registry *Registry[C], timeout time.Duration) {
+	remaining := registry.Len()
+	if remaining == 0 {
+		return
+	}
+	Logger.Info("draining connections", zap.Int("connections", remaining), zap.Duration("timeout", timeout))
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for remaining > 0 && time.Now().Before(deadline) {
+		<-ticker.C
+		remaining = registry.Len()
+	}
+	if remaining > 0 {
+		Logger.Warn("drain timeout, closing remaining connections", zap.Int("connections", remaining))
+		return
+	}
+	Logger.Info("drained all connections")
+}
+
+func parseRights(oob []byte) ([]int, error) {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, fmt.Errorf("parse control message failed: %w", err)
+	}
+	var fds []int
+	for _, msg := range msgs {
+		rights, err := unix.ParseUnixRights(&msg)
+		if err != nil {
+			return nil, fmt.Errorf("parse unix rights failed: %w", err)
+		}
+		fds = append(fds, rights...)
+	}
+	return fds, nil
+}
+
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		_ = unix.Close(fd)
+	}
+}
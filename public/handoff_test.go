@@ -0,0 +1,142 @@
+package public
+
+import (
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+	"golang.org/x/sys/unix"
+)
+
+// tcpPair 返回一对已连接的 tcp 连接
+func tcpPair(t *testing.T) (server, client net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	client, err = net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	if server, err = ln.Accept(); err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = server.Close()
+		_ = client.Close()
+	})
+	return server, client
+}
+
+// TestServeHandoffPeerDiesBeforeAck 新进程在 ack 之前退出时, 旧进程的 listener 和连接保持可用并交还给 restore,
+// 之后的新进程仍然可以完成交接
+func TestServeHandoffPeerDiesBeforeAck(t *testing.T) {
+	Logger = zaptest.NewLogger(t)
+	path := filepath.Join(t.TempDir(), "handoff.sock")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	server, client := tcpPair(t)
+	conn := NewConn(server)
+
+	restored := make(chan *Inheritance, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- ServeHandoff(path, func() *Inheritance {
+			return &Inheritance{Listeners: []net.Listener{ln}, Conns: []net.Conn{conn}}
+		}, func(inh *Inheritance) { restored <- inh })
+	}()
+
+	// 第一个新进程读到 header 后不 ack 就断开
+	var peer net.Conn
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		if peer, err = net.Dial("unixpacket", path); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("dial handoff socket: %v", err)
+	}
+	if _, err := peer.Read(make([]byte, handoffHeaderLen)); err != nil {
+		t.Fatalf("read header: %v", err)
+	}
+	_ = peer.Close()
+
+	select {
+	case inh := <-restored:
+		if len(inh.Conns) != 1 || inh.Conns[0] != net.Conn(conn) {
+			t.Fatalf("restored conns = %v, want the exported conn", inh.Conns)
+		}
+	case err := <-served:
+		t.Fatalf("ServeHandoff returned %v after a failed handoff", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("restore not called after the peer disconnected")
+	}
+
+	// listener 和连接都没有被关闭, 也仍然是非阻塞的
+	rc, err := server.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("SyscallConn: %v", err)
+	}
+	var flags int
+	if err := rc.Control(func(fd uintptr) { flags, _ = unix.FcntlInt(fd, unix.F_GETFL, 0) }); err != nil {
+		t.Fatalf("Control: %v", err)
+	}
+	if flags&unix.O_NONBLOCK == 0 {
+		t.Fatal("kept conn switched to blocking mode by the handoff")
+	}
+	accepted := make(chan error, 1)
+	go func() {
+		c, err := ln.Accept()
+		if err == nil {
+			_ = c.Close()
+		}
+		accepted <- err
+	}()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial listener after failed handoff: %v", err)
+	}
+	_ = dialed.Close()
+	if err := <-accepted; err != nil {
+		t.Fatalf("accept after failed handoff: %v", err)
+	}
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
+		t.Fatalf("set deadline on the kept conn: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read on the kept conn = %q, %v", buf, err)
+	}
+
+	// 第二个新进程正常接管
+	inh, err := Inherit(path)
+	if err != nil {
+		t.Fatalf("Inherit: %v", err)
+	}
+	if len(inh.Listeners) != 1 || len(inh.Conns) != 1 {
+		t.Fatalf("inherited %d listeners and %d conns, want 1 and 1", len(inh.Listeners), len(inh.Conns))
+	}
+	for _, ln := range inh.Listeners {
+		_ = ln.Close()
+	}
+	for _, c := range inh.Conns {
+		_ = c.Close()
+	}
+	if err := <-served; err != nil {
+		t.Fatalf("ServeHandoff: %v", err)
+	}
+	if _, err := ln.Accept(); err == nil {
+		t.Fatal("old listener still open after a successful handoff")
+	}
+}
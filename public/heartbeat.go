@@ -0,0 +1,149 @@
+package public
+
+import (
+	"context"
+	"fmt"
+	"server_millionclient/public/protocol"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// HeartbeatMode 心跳由哪一端发起
+type HeartbeatMode int
+
+const (
+	HeartbeatOff HeartbeatMode = iota
+	// HeartbeatClient 客户端定时发 ping, 服务端回 pong 并只做超时检测
+	HeartbeatClient
+	// HeartbeatServer 服务端定时发 ping, 客户端回 pong
+	HeartbeatServer
+)
+
+func ParseHeartbeatMode(s string) (HeartbeatMode, error) {
+	switch s {
+	case "", "off":
+		return HeartbeatOff, nil
+	case "client":
+		return HeartbeatClient, nil
+	case "server":
+		return HeartbeatServer, nil
+	}
+	return HeartbeatOff, fmt.Errorf("unknown heartbeat mode: %s", s)
+}
+
+func (m HeartbeatMode) String() string {
+	switch m {
+	case HeartbeatClient:
+		return "client"
+	case HeartbeatServer:
+		return "server"
+	}
+	return "off"
+}
+
+// Heartbeat 存活检测. 连续错过 maxMiss 个心跳(期间没有收到任何帧)的连接被驱逐,
+// HeartbeatServer 模式下每个 interval 还会向空闲的连接发送 ping.
+// C 为各 backend 的连接类型(net.Conn / gnet.Conn)
+type Heartbeat[C comparable] struct {
+	registry *Registry[C]
+	mode     HeartbeatMode
+	interval time.Duration
+	maxMiss  int
+	ping     func(C, []byte) error
+	evict    func(C)
+}
+
+// NewHeartbeat 检测 registry 中的连接, ping 负责把 ping 帧写给连接, evict 负责关闭连接
+func NewHeartbeat[C comparable](registry *Registry[C], mode HeartbeatMode, interval time.Duration, maxMiss int,
+	ping func(C, []byte) error, evict func(C)) *Heartbeat[C] {
+	return &Heartbeat[C]{
+		registry: registry,
+		mode:     mode,
+		interval: interval,
+		maxMiss:  max(maxMiss, 1),
+		ping:     ping,
+		evict:    evict,
+	}
+}
+
+// Run 阻塞执行检测, 直到 ctx 结束
+func (h *Heartbeat[C]) Run(ctx context.Context) {
+	if h.mode == HeartbeatOff || h.interval <= 0 {
+		return
+	}
+	Logger.Info("heartbeat started", zap.Stringer("mode", h.mode),
+		zap.Duration("interval", h.interval), zap.Int("maxMiss", h.maxMiss))
+
+	// server 模式下空闲满一个 interval 才发出第一个 ping, 从那之后再错过 maxMiss 次才驱逐
+	deadline := h.interval * time.Duration(h.maxMiss)
+	if h.mode == HeartbeatServer {
+		deadline += h.interval
+	}
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	var evicts, pings []C
+	var pingPeers []*Peer
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// 在遍历之外执行 ping/evict, 避免长时间持有 registry 的锁
+		now := time.Now()
+		evicts, pings, pingPeers = evicts[:0], pings[:0], pingPeers[:0]
+		h.registry.Range(func(conn C, peer *Peer) bool {
+			idle := peer.Idle(now)
+			if idle >= deadline {
+				peer.MarkClose(CloseTimeout)
+				evicts = append(evicts, conn)
+			} else if h.mode == HeartbeatServer && idle >= h.interval {
+				pings = append(pings, conn)
+				pingPeers = append(pingPeers, peer)
+			}
+			return true
+		})
+
+		for _, conn := range evicts {
+			h.evict(conn)
+		}
+		HeartbeatEvictions.Add(float64(len(evicts)))
+		if len(evicts) > 0 {
+			Logger.Info("heartbeat evicted dead peers", zap.Int("cnt", len(evicts)))
+		}
+
+		if len(pings) == 0 {
+			continue
+		}
+		frame, err := protocol.PackPing(now)
+		if err != nil {
+			Logger.Error("pack ping failed", zap.Error(err))
+			continue
+		}
+		for i, conn := range pings {
+			if err := h.ping(conn, frame); err != nil {
+				Logger.Debug("ping failed", zap.Error(err))
+				continue
+			}
+			pingPeers[i].FrameOut(len(frame))
+		}
+	}
+}
+
+// HandleHeartbeat 处理心跳帧: ping 返回需要回写的 pong 帧, pong 记录 RTT.
+// 非心跳帧返回 handled=false
+func HandleHeartbeat(header protocol.Header, body []byte) (reply []byte, handled bool, err error) {
+	switch header.Type {
+	case protocol.TypePing:
+		reply, err = protocol.PackFrame(protocol.TypePong, body)
+		return reply, true, err
+	case protocol.TypePong:
+		if sent, ok := protocol.PingTime(body); ok {
+			HeartbeatRTT.Observe(time.Since(sent).Seconds())
+		}
+		return nil, true, nil
+	}
+	return nil, false, nil
+}
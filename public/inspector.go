@@ -0,0 +1,147 @@
+package public
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// inspectorMaxTop /connections/top 一次最多返回的连接数
+const inspectorMaxTop = 1000
+
+// TLSInfo 连接的 tls 状态, 握手完成后设置, 之后不再修改
+type TLSInfo struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	ServerName  string `json:"server_name,omitempty"`
+	Resumed     bool   `json:"resumed"`
+	// KTLS 加解密已经交给内核, 见 EnableKTLS
+	KTLS bool `json:"ktls,omitempty"`
+}
+
+func NewTLSInfo(state tls.ConnectionState) *TLSInfo {
+	return &TLSInfo{
+		Version:     tls.VersionName(state.Version),
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ServerName:  state.ServerName,
+		Resumed:     state.DidResume,
+	}
+}
+
+// ConnInfo 一个连接的统计, 由 /connections/top 和 /connections/{id} 返回
+type ConnInfo struct {
+	ID          uint64    `json:"id"`
+	Remote      string    `json:"remote"`
+	ConnectedAt time.Time `json:"connected_at"`
+	AgeSeconds  float64   `json:"age_seconds"`
+	// IdleSeconds 距离上次收到对端帧的时长
+	IdleSeconds float64 `json:"idle_seconds"`
+	FramesIn    uint64  `json:"frames_in"`
+	FramesOut   uint64  `json:"frames_out"`
+	BytesIn     uint64  `json:"bytes_in"`
+	BytesOut    uint64  `json:"bytes_out"`
+	// Poller 连接所属事件循环的序号, 与 poller 标签相同
+	Poller   string   `json:"poller,omitempty"`
+	Identity string   `json:"identity,omitempty"`
+	Tenant   string   `json:"tenant,omitempty"`
+	Protocol string   `json:"protocol,omitempty"`
+	TLS      *TLSInfo `json:"tls,omitempty"`
+}
+
+// Info 连接当前的统计
+func (p *Peer) Info(now time.Time) ConnInfo {
+	info := ConnInfo{
+		ID:          p.ID,
+		ConnectedAt: p.ConnectedAt,
+		AgeSeconds:  now.Sub(p.ConnectedAt).Seconds(),
+		IdleSeconds: p.Idle(now).Seconds(),
+		FramesIn:    p.framesIn.Load(),
+		FramesOut:   p.framesOut.Load(),
+		BytesIn:     p.bytesIn.Load(),
+		BytesOut:    p.bytesOut.Load(),
+		Poller:      p.Loop.Name(),
+		Identity:    p.Identity,
+		Tenant:      p.Tenant,
+		Protocol:    p.Protocol,
+		TLS:         p.TLS,
+	}
+	if p.ClientAddr != nil {
+		info.Remote = p.ClientAddr.String()
+	}
+	return info
+}
+
+// connOrders /connections/top 支持的排序字段, 都是从大到小
+var connOrders = map[string]func(a, b *Peer) bool{
+	"bytes_in":   func(a, b *Peer) bool { return a.bytesIn.Load() > b.bytesIn.Load() },
+	"bytes_out":  func(a, b *Peer) bool { return a.bytesOut.Load() > b.bytesOut.Load() },
+	"frames_in":  func(a, b *Peer) bool { return a.framesIn.Load() > b.framesIn.Load() },
+	"frames_out": func(a, b *Peer) bool { return a.framesOut.Load() > b.framesOut.Load() },
+	// age 最早建立的连接在前
+	"age": func(a, b *Peer) bool { return a.ConnectedAt.Before(b.ConnectedAt) },
+	// idle 最久没有收到帧的连接在前
+	"idle": func(a, b *Peer) bool { return a.lastSeen.Load() < b.lastSeen.Load() },
+}
+
+// ConnInspector 管理接口 /connections 系列的数据来源, 见 Inspector
+type ConnInspector interface {
+	Summary(now time.Time) ConnSummary
+	// Top 按 by 排序的前 n 个连接
+	Top(now time.Time, by string, n int) ([]ConnInfo, error)
+	// Get 按 ID 查找连接, 不存在时返回 false
+	Get(now time.Time, id uint64) (ConnInfo, bool)
+	// Close 强制关闭连接, 不存在时返回 false
+	Close(id uint64) bool
+}
+
+// Inspector 基于 Registry 实现 ConnInspector, 按 ID 查找使用 Registry 的 ID 索引
+type Inspector[C comparable] struct {
+	registry *Registry[C]
+	// close 与心跳驱逐相同, 在事件循环之外关闭连接, 由持有连接的一方完成清理
+	close func(conn C)
+}
+
+func NewInspector[C comparable](registry *Registry[C], close func(conn C)) *Inspector[C] {
+	return &Inspector[C]{registry: registry, close: close}
+}
+
+func (i *Inspector[C]) Summary(now time.Time) ConnSummary {
+	return i.registry.Summary(now)
+}
+
+func (i *Inspector[C]) Top(now time.Time, by string, n int) ([]ConnInfo, error) {
+	less, ok := connOrders[by]
+	if !ok {
+		return nil, fmt.Errorf("unknown order: %q", by)
+	}
+	conns := i.registry.Top(min(n, inspectorMaxTop), less)
+	infos := make([]ConnInfo, 0, len(conns))
+	for _, conn := range conns {
+		// 排序之后连接可能已经关闭
+		if peer := i.registry.Peer(conn); peer != nil {
+			infos = append(infos, peer.Info(now))
+		}
+	}
+	return infos, nil
+}
+
+func (i *Inspector[C]) Get(now time.Time, id uint64) (ConnInfo, bool) {
+	_, peer, ok := i.registry.Lookup(id)
+	if !ok {
+		return ConnInfo{}, false
+	}
+	return peer.Info(now), true
+}
+
+func (i *Inspector[C]) Close(id uint64) bool {
+	conn, peer, ok := i.registry.Lookup(id)
+	if !ok {
+		return false
+	}
+	peer.MarkClose(CloseAdmin)
+	Logger.Info("close connection by admin", zap.Uint64("id", id), zap.Stringer("remote", peer.ClientAddr))
+	i.close(conn)
+	return true
+}
@@ -0,0 +1,472 @@
+package public
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"reflect"
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// linux/tls.h, x/sys/unix 中没有
+const (
+	tlsTX                     = 1
+	tlsRX                     = 2
+	tlsSetRecordType          = 1
+	tlsGetRecordType          = 2
+	tls13Version              = 0x0304
+	tlsCipherAESGCM128        = 51
+	tlsCipherAESGCM256        = 52
+	tlsCipherChaCha20Poly1305 = 54
+)
+
+// RFC 8446 中的记录类型与握手消息类型
+const (
+	recordTypeAlert           = 21
+	recordTypeApplicationData = 23
+	alertCloseNotify          = 0
+	typeKeyUpdate             = 24
+	keyUpdateRequested        = 1
+)
+
+// ktlsControlMax 读取非 application_data 记录的缓冲区大小, alert 与 KeyUpdate 都远小于它
+const ktlsControlMax = 512
+
+// ErrKTLSUnsupported 内核没有 tls 模块, 或者协商出的版本/套件无法卸载到内核
+var ErrKTLSUnsupported = errors.New("ktls unsupported")
+
+// KTLSSecrets 作为单个连接的 tls.Config.KeyLogWriter, 收集 TLS 1.3 的应用流量密钥
+type KTLSSecrets struct {
+	lock           sync.Mutex
+	client, server []byte
+}
+
+func (s *KTLSSecrets) Write(line []byte) (int, error) {
+	// 格式: <label> <client_random> <secret>
+	fields := bytes.Fields(line)
+	if len(fields) != 3 {
+		return len(line), nil
+	}
+	secret, err := hex.DecodeString(string(fields[2]))
+	if err != nil {
+		return 0, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	switch string(fields[0]) {
+	case "CLIENT_TRAFFIC_SECRET_0":
+		s.client = secret
+	case "SERVER_TRAFFIC_SECRET_0":
+		s.server = secret
+	}
+	return len(line), nil
+}
+
+// EnableKTLS 把服务端 tls 连接协商出的密钥装入内核(TCP_ULP "tls" + TLS_TX/TLS_RX),
+// 成功后返回基于底层 socket 的连接, 之后直接在它上面读写明文, conn 不能再使用.
+// 内核只处理 application_data 记录, 对端之后发来的 alert 和 KeyUpdate 由返回的连接处理, 见 ktlsConn.
+// 返回 ErrKTLSUnsupported 时 socket 没有被改动, 可以继续使用 conn;
+// 其他错误时 socket 可能只卸载了一个方向, 连接只能关闭.
+// tls.Conn 中已经读入但尚未消费的数据无法交给内核, 调用方需确保没有这样的数据
+func EnableKTLS(conn *tls.Conn, secrets *KTLSSecrets) (net.Conn, error) {
+	state := conn.ConnectionState()
+	if state.Version != tls.VersionTLS13 {
+		return nil, fmt.Errorf("%w: version %s", ErrKTLSUnsupported, tls.VersionName(state.Version))
+	}
+	secrets.lock.Lock()
+	clientSecret, serverSecret := secrets.client, secrets.server
+	secrets.lock.Unlock()
+	if clientSecret == nil || serverSecret == nil {
+		return nil, errors.New("traffic secrets not logged")
+	}
+	buffered, ok := tlsConnBuffered(conn)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown crypto/tls internals", ErrKTLSUnsupported)
+	}
+	if buffered {
+		return nil, fmt.Errorf("%w: unread data buffered in tls conn", ErrKTLSUnsupported)
+	}
+	readSeq, writeSeq, ok := tlsConnSeq(conn)
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown crypto/tls internals", ErrKTLSUnsupported)
+	}
+	rx, err := ktlsCryptoInfo(state.CipherSuite, clientSecret, readSeq)
+	if err != nil {
+		return nil, err
+	}
+	tx, err := ktlsCryptoInfo(state.CipherSuite, serverSecret, writeSeq)
+	if err != nil {
+		return nil, err
+	}
+
+	netConn, ok := unwrapConn(conn).(*net.TCPConn)
+	if !ok {
+		return nil, fmt.Errorf("%w: connection type %T", ErrKTLSUnsupported, unwrapConn(conn))
+	}
+	rc, err := netConn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var ulpErr, sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		if ulpErr = unix.SetsockoptString(int(fd), unix.SOL_TCP, unix.TCP_ULP, "tls"); ulpErr != nil {
+			return
+		}
+		if sockErr = unix.SetsockoptString(int(fd), unix.SOL_TLS, tlsTX, string(tx)); sockErr != nil {
+			// 只装了 ULP 没有设置密钥时 socket 仍按明文收发, 可以回退
+			ulpErr, sockErr = sockErr, nil
+			return
+		}
+		sockErr = unix.SetsockoptString(int(fd), unix.SOL_TLS, tlsRX, string(rx))
+	}); err != nil {
+		return nil, err
+	}
+	if ulpErr != nil {
+		return nil, fmt.Errorf("%w: %w", ErrKTLSUnsupported, ulpErr)
+	}
+	if sockErr != nil {
+		return nil, fmt.Errorf("set tls rx failed: %w", sockErr)
+	}
+	return &ktlsConn{TCPConn: netConn, rc: rc, suite: state.CipherSuite, client: clientSecret, server: serverSecret}, nil
+}
+
+// ProbeKTLS 在一对回环连接上尝试安装 kTLS, 判断内核是否支持
+func ProbeKTLS() error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		return err
+	}
+	defer server.Close()
+
+	info, err := ktlsCryptoInfo(tls.TLS_AES_128_GCM_SHA256, make([]byte, sha256.Size), [8]byte{})
+	if err != nil {
+		return err
+	}
+	rc, err := server.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := rc.Control(func(fd uintptr) {
+		if sockErr = unix.SetsockoptString(int(fd), unix.SOL_TCP, unix.TCP_ULP, "tls"); sockErr != nil {
+			return
+		}
+		if sockErr = unix.SetsockoptString(int(fd), unix.SOL_TLS, tlsTX, string(info)); sockErr != nil {
+			return
+		}
+		sockErr = unix.SetsockoptString(int(fd), unix.SOL_TLS, tlsRX, string(info))
+	}); err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("%w: %w", ErrKTLSUnsupported, sockErr)
+	}
+	return nil
+}
+
+// ktlsCryptoInfo 按 linux/tls.h 的 tls12_crypto_info_* 布局生成 setsockopt 参数.
+// TLS 1.3 的 12 字节 iv 在 AES-GCM 中拆成 salt(前 4 字节) + iv(后 8 字节)
+func ktlsCryptoInfo(suite uint16, secret []byte, seq [8]byte) ([]byte, error) {
+	cipherType, keyLen, newHash, err := ktlsCipher(suite)
+	if err != nil {
+		return nil, err
+	}
+	key := hkdfExpandLabel(newHash, secret, "key", keyLen)
+	iv := hkdfExpandLabel(newHash, secret, "iv", 12)
+
+	info := binary.LittleEndian.AppendUint16(nil, tls13Version)
+	info = binary.LittleEndian.AppendUint16(info, cipherType)
+	if cipherType == tlsCipherChaCha20Poly1305 {
+		// iv[12] key[32] salt[0] rec_seq[8]
+		info = append(info, iv...)
+		info = append(info, key...)
+	} else {
+		// iv[8] key[16|32] salt[4] rec_seq[8]
+		info = append(info, iv[4:]...)
+		info = append(info, key...)
+		info = append(info, iv[:4]...)
+	}
+	return append(info, seq[:]...), nil
+}
+
+// ktlsCipher 套件对应的内核 cipher 类型, 密钥长度和 hash
+func ktlsCipher(suite uint16) (cipherType uint16, keyLen int, newHash func() hash.Hash, err error) {
+	switch suite {
+	case tls.TLS_AES_128_GCM_SHA256:
+		return tlsCipherAESGCM128, 16, sha256.New, nil
+	case tls.TLS_AES_256_GCM_SHA384:
+		return tlsCipherAESGCM256, 32, sha512.New384, nil
+	case tls.TLS_CHACHA20_POLY1305_SHA256:
+		return tlsCipherChaCha20Poly1305, 32, sha256.New, nil
+	}
+	return 0, 0, nil, fmt.Errorf("%w: cipher suite %s", ErrKTLSUnsupported, tls.CipherSuiteName(suite))
+}
+
+// hkdfExpandLabel RFC 8446 7.1 HKDF-Expand-Label, context 为空
+func hkdfExpandLabel(newHash func() hash.Hash, secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := binary.BigEndian.AppendUint16(nil, uint16(length))
+	info = append(info, byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+
+	// HKDF-Expand: T(i) = HMAC(secret, T(i-1) | info | i)
+	var out, t []byte
+	for i := byte(1); len(out) < length; i++ {
+		mac := hmac.New(newHash, secret)
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:length]
+}
+
+// tlsConnSeq 通过反射取出 tls.Conn 读写两个方向的记录序号, 内核需要从这里接着计数.
+// 这些是 crypto/tls 的未导出字段, 结构与预期不符时 ok 为 false, 调用方回退到用户态 tls
+func tlsConnSeq(conn *tls.Conn) (read, write [8]byte, ok bool) {
+	v := reflect.ValueOf(conn).Elem()
+	in, inOk := reflectField(v, reflect.Array, "in", "seq")
+	out, outOk := reflectField(v, reflect.Array, "out", "seq")
+	if !inOk || !outOk || in.Len() != 8 || out.Len() != 8 || in.Type().Elem().Kind() != reflect.Uint8 || out.Type().Elem().Kind() != reflect.Uint8 {
+		return read, write, false
+	}
+	for i := range 8 {
+		read[i] = byte(in.Index(i).Uint())
+		write[i] = byte(out.Index(i).Uint())
+	}
+	return read, write, true
+}
+
+// tlsConnBuffered tls.Conn 中是否还有已从底层读入但尚未交给调用方的数据, 字段结构与预期不符时 ok 为 false
+func tlsConnBuffered(conn *tls.Conn) (buffered, ok bool) {
+	v := reflect.ValueOf(conn).Elem()
+	// bytes.Buffer: buf[off:], bytes.Reader: s[i:]
+	rawBuf, ok1 := reflectField(v, reflect.Slice, "rawInput", "buf")
+	rawOff, ok2 := reflectField(v, reflect.Int, "rawInput", "off")
+	input, ok3 := reflectField(v, reflect.Slice, "input", "s")
+	inputOff, ok4 := reflectField(v, reflect.Int64, "input", "i")
+	if !ok1 || !ok2 || !ok3 || !ok4 {
+		return false, false
+	}
+	return rawBuf.Len() > int(rawOff.Int()) || input.Len() > int(inputOff.Int()), true
+}
+
+// reflectField 按 path 逐级取结构体字段, 中途不是结构体, 字段不存在或者最后的类型不是 kind 时返回 false
+func reflectField(v reflect.Value, kind reflect.Kind, path ...string) (reflect.Value, bool) {
+	for _, name := range path {
+		if v.Kind() != reflect.Struct {
+			return reflect.Value{}, false
+		}
+		if v = v.FieldByName(name); !v.IsValid() {
+			return reflect.Value{}, false
+		}
+	}
+	return v, v.Kind() == kind
+}
+
+// ktlsConn 卸载到内核之后的连接. 内核只解密 application_data 记录, 其他记录普通的 read 返回 EIO,
+// 因此通过 recvmsg 的 TLS_GET_RECORD_TYPE 控制消息取出记录类型:
+// close_notify 作为 EOF, 其他 alert 作为错误; 客户端的 KeyUpdate 按 RFC 8446 4.6.3 推导新密钥并重新装入内核,
+// 对端要求时回复 KeyUpdate 并更新发送方向的密钥(内核 6.14 之前不支持更新密钥, 连接以错误关闭).
+// 服务端在握手中已经发完 NewSessionTicket, 之后不会再发送握手消息
+type ktlsConn struct {
+	*net.TCPConn
+	rc    syscall.RawConn
+	suite uint16
+	// client, server 当前的流量密钥, 只由读取的 goroutine 修改
+	client, server []byte
+	// writeLock 回复 KeyUpdate 与普通写互斥, 避免记录交错
+	writeLock sync.Mutex
+	// pending 读入 control 缓冲区但调用方没有取走的明文
+	pending []byte
+	control [ktlsControlMax]byte
+}
+
+// NetConn 返回底层的 socket, 见 unwrapConn
+func (c *ktlsConn) NetConn() net.Conn {
+	return c.TCPConn
+}
+
+func (c *ktlsConn) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+	if len(c.pending) > 0 {
+		n := copy(b, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	for {
+		// 非 application_data 记录需要完整读出, b 较小时先读入 control
+		buf := b
+		if len(buf) < ktlsControlMax {
+			buf = c.control[:]
+		}
+		n, recordType, err := c.recv(buf)
+		if err != nil {
+			return 0, err
+		}
+		switch recordType {
+		case recordTypeApplicationData:
+			if n == 0 {
+				return 0, io.EOF
+			}
+			if len(b) < ktlsControlMax {
+				copied := copy(b, buf[:n])
+				c.pending = buf[copied:n]
+				return copied, nil
+			}
+			return n, nil
+		case recordTypeAlert:
+			if n >= 2 && buf[1] == alertCloseNotify {
+				return 0, io.EOF
+			}
+			return 0, fmt.Errorf("ktls: received alert %v", buf[:n])
+		case recordTypeHandshake:
+			if err := c.handlePostHandshake(buf[:n]); err != nil {
+				return 0, err
+			}
+		default:
+			return 0, fmt.Errorf("ktls: unexpected record type %d", recordType)
+		}
+	}
+}
+
+// recv 读取一个记录中的明文, 对端关闭时 n 为 0, recordType 为 application_data
+func (c *ktlsConn) recv(b []byte) (n int, recordType byte, err error) {
+	var oob [64]byte
+	var oobn int
+	if err := c.rc.Read(func(fd uintptr) bool {
+		n, oobn, _, _, err = unix.Recvmsg(int(fd), b, oob[:], 0)
+		return err != unix.EAGAIN
+	}); err != nil {
+		return 0, 0, err
+	}
+	if err != nil {
+		return 0, 0, &net.OpError{Op: "read", Net: "tcp", Source: c.LocalAddr(), Addr: c.RemoteAddr(), Err: err}
+	}
+	recordType = recordTypeApplicationData
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level == unix.SOL_TLS && msg.Header.Type == tlsGetRecordType && len(msg.Data) > 0 {
+			recordType = msg.Data[0]
+		}
+	}
+	return n, recordType, nil
+}
+
+// handlePostHandshake 处理客户端在握手之后发来的握手消息, 只接受 KeyUpdate
+func (c *ktlsConn) handlePostHandshake(b []byte) error {
+	for len(b) > 0 {
+		// type(1) + length(3) + body
+		if len(b) < 4 {
+			return errors.New("ktls: fragmented post-handshake message")
+		}
+		length := int(b[1])<<16 | int(b[2])<<8 | int(b[3])
+		if len(b) < 4+length {
+			return errors.New("ktls: fragmented post-handshake message")
+		}
+		msgType, body := b[0], b[4:4+length]
+		b = b[4+length:]
+		if msgType != typeKeyUpdate || len(body) != 1 {
+			return fmt.Errorf("ktls: unexpected post-handshake message %d", msgType)
+		}
+		if err := c.updateKey(tlsRX, &c.client); err != nil {
+			return err
+		}
+		if body[0] == keyUpdateRequested {
+			if err := c.sendKeyUpdate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// updateKey 按 RFC 8446 7.2 推导下一代流量密钥, 序号从 0 开始, 装入内核 dir 方向
+func (c *ktlsConn) updateKey(dir int, secret *[]byte) error {
+	_, _, newHash, err := ktlsCipher(c.suite)
+	if err != nil {
+		return err
+	}
+	next := hkdfExpandLabel(newHash, *secret, "traffic upd", newHash().Size())
+	info, err := ktlsCryptoInfo(c.suite, next, [8]byte{})
+	if err != nil {
+		return err
+	}
+	var sockErr error
+	if err := c.rc.Control(func(fd uintptr) {
+		sockErr = unix.SetsockoptString(int(fd), unix.SOL_TLS, dir, string(info))
+	}); err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("ktls: update key failed: %w", sockErr)
+	}
+	*secret = next
+	return nil
+}
+
+// sendKeyUpdate 回复不要求对端更新的 KeyUpdate, 之后发送方向使用新密钥
+func (c *ktlsConn) sendKeyUpdate() error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	msg := []byte{typeKeyUpdate, 0, 0, 1, 0}
+	oob := ktlsRecordTypeCmsg(recordTypeHandshake)
+	var err error
+	if ctrlErr := c.rc.Write(func(fd uintptr) bool {
+		err = unix.Sendmsg(int(fd), msg, oob, nil, 0)
+		return err != unix.EAGAIN
+	}); ctrlErr != nil {
+		return ctrlErr
+	}
+	if err != nil {
+		return fmt.Errorf("ktls: send key update failed: %w", err)
+	}
+	return c.updateKey(tlsTX, &c.server)
+}
+
+// ktlsRecordTypeCmsg sendmsg 的 TLS_SET_RECORD_TYPE 控制消息
+func ktlsRecordTypeCmsg(recordType byte) []byte {
+	b := make([]byte, unix.CmsgSpace(1))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&b[0]))
+	h.Level = unix.SOL_TLS
+	h.Type = tlsSetRecordType
+	h.SetLen(unix.CmsgLen(1))
+	b[unix.CmsgLen(0)] = recordType
+	return b
+}
+
+func (c *ktlsConn) Write(b []byte) (int, error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	return c.TCPConn.Write(b)
+}
@@ -1,25 +1,84 @@
 package public
 
 import (
+	"fmt"
 	"os"
 	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 var Logger *zap.Logger
 
+// LogLevel Logger 当前的级别, 可以在运行时通过管理接口的 /log/level 修改
+var LogLevel = zap.NewAtomicLevel()
+
+// LogConfig 日志配置. InitLogger 使用 console 格式输出到 stderr, 采样参数为 2/50
+type LogConfig struct {
+	Debug bool
+	// Format console 或 json
+	Format string
+	// File 日志文件, 按 MaxSize 轮转; 为空时输出到 stderr
+	File string
+	// MaxSize 单个日志文件的大小上限(MB), 为 0 时是 lumberjack 默认的 100MB. MaxBackups/MaxAge 为保留的旧文件个数/天数, 0 表示不限
+	MaxSize    int
+	MaxBackups int
+	MaxAge     int
+	// SampleInitial 每秒每种消息先记录 SampleInitial 条, 之后每 SampleThereafter 条记录一条(为 0 时全部丢弃).
+	// SampleInitial 为 0 时不采样
+	SampleInitial    int
+	SampleThereafter int
+}
+
 func InitLogger(debugMode bool) {
-	lv := zapcore.InfoLevel
-	if debugMode {
-		lv = zapcore.DebugLevel
+	_ = InitLoggerConfig(LogConfig{Debug: debugMode, Format: "console", SampleInitial: 2, SampleThereafter: 50})
+}
+
+// InitLoggerConfig 按配置创建 Logger. 配置不合法时返回错误, 此时 Logger 为输出到 stderr 的默认配置, 可以用来报告错误
+func InitLoggerConfig(cfg LogConfig) error {
+	var enc zapcore.Encoder
+	switch cfg.Format {
+	case "console":
+		enc = zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig())
+	case "json":
+		encCfg := zap.NewProductionEncoderConfig()
+		encCfg.EncodeTime = zapcore.ISO8601TimeEncoder
+		encCfg.EncodeDuration = zapcore.StringDurationEncoder
+		enc = zapcore.NewJSONEncoder(encCfg)
+	default:
+		InitLogger(cfg.Debug)
+		return fmt.Errorf("unknown log format: %q", cfg.Format)
 	}
 
-	// create logger with sampler
-	encCfg := zap.NewDevelopmentEncoderConfig()
-	enc := zapcore.NewConsoleEncoder(encCfg)
-	core := zapcore.NewCore(enc, zapcore.AddSync(zapcore.Lock(os.Stderr)), lv)
-	sampler := zapcore.NewSamplerWithOptions(core, time.Second, 2, 50)
-	Logger = zap.New(sampler, zap.Development(), zap.AddCaller())
+	LogLevel.SetLevel(zapcore.InfoLevel)
+	if cfg.Debug {
+		LogLevel.SetLevel(zapcore.DebugLevel)
+	}
+
+	out := zapcore.Lock(os.Stderr)
+	if cfg.File != "" {
+		// lumberjack 自己加锁
+		out = zapcore.AddSync(&lumberjack.Logger{
+			Filename:   cfg.File,
+			MaxSize:    cfg.MaxSize,
+			MaxBackups: cfg.MaxBackups,
+			MaxAge:     cfg.MaxAge,
+			Compress:   true,
+		})
+	}
+
+	core := zapcore.NewCore(enc, out, LogLevel)
+	if cfg.SampleInitial > 0 {
+		// 被采样丢弃的日志计入 LogsDropped, 避免排查问题时误以为没有发生
+		core = zapcore.NewSamplerWithOptions(core, time.Second, cfg.SampleInitial, cfg.SampleThereafter,
+			zapcore.SamplerHook(func(entry zapcore.Entry, dec zapcore.SamplingDecision) {
+				if dec&zapcore.LogDropped != 0 {
+					LogsDropped.WithLabelValues(entry.Level.String()).Inc()
+				}
+			}))
+	}
+	Logger = zap.New(core, zap.Development(), zap.AddCaller())
+	return nil
 }
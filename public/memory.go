@@ -0,0 +1,289 @@
+package public
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// MemoryStage 内存压力等级, 等级越高处理越激进, 且包含低等级的处理
+type MemoryStage int32
+
+const (
+	MemoryNormal MemoryStage = iota
+	// MemoryStopAccept 停止接受新连接
+	MemoryStopAccept
+	// MemoryShrink 缩小连接的 socket 缓冲区并归还空闲内存给操作系统
+	MemoryShrink
+	// MemoryShed 每个周期关闭一部分连接
+	MemoryShed
+)
+
+func (s MemoryStage) String() string {
+	switch s {
+	case MemoryStopAccept:
+		return "stop_accept"
+	case MemoryShrink:
+		return "shrink"
+	case MemoryShed:
+		return "shed"
+	}
+	return "normal"
+}
+
+const (
+	memoryCheckInterval = time.Second
+	// memoryHysteresis 降级时需要低于阈值的比例, 避免在阈值附近来回切换
+	memoryHysteresis = 0.05
+	// memoryShedRatio MemoryShed 每个周期关闭的连接比例
+	memoryShedRatio = 0.01
+	// shrunkBufferSize MemoryShrink 时 socket 收发缓冲区的大小
+	shrunkBufferSize = 4096
+)
+
+var memoryStage atomic.Int32
+
+// CurrentMemoryStage 当前的内存压力等级, Admission 据此拒绝新连接
+func CurrentMemoryStage() MemoryStage {
+	return MemoryStage(memoryStage.Load())
+}
+
+// ShedPolicy MemoryShed 时优先关闭哪些连接
+type ShedPolicy int
+
+const (
+	ShedNewest ShedPolicy = iota
+	ShedIdlest
+)
+
+func ParseShedPolicy(s string) (ShedPolicy, error) {
+	switch s {
+	case "newest":
+		return ShedNewest, nil
+	case "idlest":
+		return ShedIdlest, nil
+	}
+	return ShedNewest, fmt.Errorf("unknown shed policy: %s", s)
+}
+
+// ParseMemoryThresholds 解析 "0.7,0.8,0.9" 形式的阈值, 依次对应 MemoryStopAccept/MemoryShrink/MemoryShed
+func ParseMemoryThresholds(s string) ([3]float64, error) {
+	var thresholds [3]float64
+	parts := strings.Split(s, ",")
+	if len(parts) != len(thresholds) {
+		return thresholds, fmt.Errorf("need %d thresholds: %s", len(thresholds), s)
+	}
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return thresholds, fmt.Errorf("parse threshold %q failed: %w", part, err)
+		}
+		if i > 0 && v < thresholds[i-1] {
+			return thresholds, fmt.Errorf("thresholds must be ascending: %s", s)
+		}
+		thresholds[i] = v
+	}
+	return thresholds, nil
+}
+
+// MemoryGuard 根据内存使用率逐级降载.
+// 使用量取 Go runtime 映射的内存与 cgroup 工作集的较大值. 工作集为 memory.current 减去 inactive_file,
+// 与 kubelet 判断驱逐的口径相同, 不包括可以随时回收的页缓存(如滚动的日志文件),
+// 上限取 limit 参数, 未指定时取 cgroup memory.max 与 GOMEMLIMIT 的较小值
+type MemoryGuard[C comparable] struct {
+	registry   *Registry[C]
+	limit      uint64
+	thresholds [3]float64
+	policy     ShedPolicy
+	shrink     func(C, int)
+	shed       func(C)
+}
+
+// NewMemoryGuard shrink 把连接的 socket 缓冲区设置为指定大小, shed 负责关闭连接
+func NewMemoryGuard[C comparable](registry *Registry[C], limit uint64, thresholds [3]float64, policy ShedPolicy,
+	shrink func(C, int), shed func(C)) *MemoryGuard[C] {
+	if limit == 0 {
+		limit = detectMemoryLimit()
+	}
+	return &MemoryGuard[C]{
+		registry:   registry,
+		limit:      limit,
+		thresholds: thresholds,
+		policy:     policy,
+		shrink:     shrink,
+		shed:       shed,
+	}
+}
+
+// Run 阻塞执行检测, 直到 ctx 结束. 没有可用的内存上限时直接返回
+func (g *MemoryGuard[C]) Run(ctx context.Context) {
+	if g.limit == 0 {
+		Logger.Info("memory guard disabled, no memory limit found")
+		return
+	}
+	Logger.Info("memory guard started", zap.Uint64("limit", g.limit), zap.Float64s("thresholds", g.thresholds[:]))
+
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	ticker := time.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		metrics.Read(samples)
+		used := samples[0].Value.Uint64() - samples[1].Value.Uint64()
+		if workingSet, ok := cgroupWorkingSet(); ok {
+			used = max(used, workingSet)
+		}
+		ratio := float64(used) / float64(g.limit)
+		MemoryUsageRatio.Set(ratio)
+
+		prev := CurrentMemoryStage()
+		stage := g.stageOf(ratio, prev)
+		if stage != prev {
+			memoryStage.Store(int32(stage))
+			MemoryStageGauge.Set(float64(stage))
+			MemoryStageTransitions.WithLabelValues(stage.String()).Inc()
+			Logger.Warn("memory stage changed", zap.Stringer("from", prev), zap.Stringer("to", stage),
+				zap.Uint64("used", used), zap.Uint64("limit", g.limit), zap.Float64("ratio", ratio))
+		}
+
+		if stage >= MemoryShrink && prev < MemoryShrink {
+			g.shrinkConns()
+			debug.FreeOSMemory()
+		}
+		if stage >= MemoryShed {
+			g.shedConns()
+		}
+	}
+}
+
+// shrinkConns 缩小所有连接的 socket 缓冲区. 每次复制一段连接, 在 registry 的锁之外 setsockopt,
+// 百万连接时也不会长时间阻塞事件循环的 Add/Remove. 期间新建立的连接可能被跳过, 个别连接可能设置两次
+func (g *MemoryGuard[C]) shrinkConns() {
+	var conns []C
+	next := 0
+	for remaining := g.registry.Len(); remaining > 0; remaining -= registryChunk {
+		conns, next = g.registry.Slice(next, min(remaining, registryChunk))
+		for _, conn := range conns {
+			g.shrink(conn, shrunkBufferSize)
+		}
+	}
+}
+
+func (g *MemoryGuard[C]) stageOf(ratio float64, prev MemoryStage) MemoryStage {
+	stage := MemoryNormal
+	for i, threshold := range g.thresholds {
+		// 当前等级及以下的阈值降低 memoryHysteresis, 使用率需要明显回落才会降级
+		if MemoryStage(i+1) <= prev {
+			threshold -= memoryHysteresis
+		}
+		if ratio >= threshold {
+			stage = MemoryStage(i + 1)
+		}
+	}
+	return stage
+}
+
+// shedConns 关闭一部分连接. 上个周期关闭的连接可能还没有从 registry 中移除, 排在最后并跳过, 不重复计数
+func (g *MemoryGuard[C]) shedConns() {
+	n := int(math.Ceil(float64(g.registry.Len()) * memoryShedRatio))
+	less := func(a, b *Peer) bool { return a.ConnectedAt.After(b.ConnectedAt) }
+	if g.policy == ShedIdlest {
+		now := time.Now()
+		less = func(a, b *Peer) bool { return a.Idle(now) > b.Idle(now) }
+	}
+	byPolicy := less
+	less = func(a, b *Peer) bool {
+		if a.Closing() != b.Closing() {
+			return b.Closing()
+		}
+		return byPolicy(a, b)
+	}
+	shed := 0
+	for _, conn := range g.registry.Top(n, less) {
+		if peer := g.registry.Peer(conn); peer == nil || !peer.MarkClose(CloseShed) {
+			continue
+		}
+		g.shed(conn)
+		shed++
+	}
+	MemoryShedConnections.Add(float64(shed))
+	if shed > 0 {
+		Logger.Warn("memory shed connections", zap.Int("cnt", shed))
+	}
+}
+
+// detectMemoryLimit 取 cgroup memory.max 与 GOMEMLIMIT 的较小值, 都没有时返回 0
+func detectMemoryLimit() uint64 {
+	var limit uint64
+	if v, ok := readCgroupUint("memory.max", "memory/memory.limit_in_bytes"); ok && v > 0 {
+		limit = v
+	}
+	if v := debug.SetMemoryLimit(-1); v > 0 && v != math.MaxInt64 && (limit == 0 || uint64(v) < limit) {
+		limit = uint64(v)
+	}
+	return limit
+}
+
+// cgroupWorkingSet cgroup 的内存使用量减去不活跃的文件页缓存
+func cgroupWorkingSet() (uint64, bool) {
+	current, ok := readCgroupUint("memory.current", "memory/memory.usage_in_bytes")
+	if !ok {
+		return 0, false
+	}
+	inactive, _ := readCgroupStat("memory.stat", "inactive_file", "memory/memory.stat", "total_inactive_file")
+	if inactive > current {
+		return 0, true
+	}
+	return current - inactive, true
+}
+
+// readCgroupStat 依次读取 cgroup v2/v1 的 memory.stat 中 key 对应的值
+func readCgroupStat(v2, v2Key, v1, v1Key string) (uint64, bool) {
+	for _, file := range []struct{ path, key string }{{"/sys/fs/cgroup/" + v2, v2Key}, {"/sys/fs/cgroup/" + v1, v1Key}} {
+		raw, err := os.ReadFile(file.path)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(raw), "\n") {
+			if v, ok := strings.CutPrefix(line, file.key+" "); ok {
+				n, err := strconv.ParseUint(strings.TrimSpace(v), 10, 64)
+				return n, err == nil
+			}
+		}
+		return 0, false
+	}
+	return 0, false
+}
+
+// readCgroupUint 依次读取 cgroup v2/v1 下的文件, "max" 以及 v1 下表示不限制的超大值返回 false
+func readCgroupUint(v2, v1 string) (uint64, bool) {
+	for _, path := range []string{"/sys/fs/cgroup/" + v2, "/sys/fs/cgroup/" + v1} {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		v, err := strconv.ParseUint(strings.TrimSpace(string(raw)), 10, 64)
+		if err != nil || v >= math.MaxInt64/2 {
+			return 0, false
+		}
+		return v, true
+	}
+	return 0, false
+}
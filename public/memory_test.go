@@ -0,0 +1,28 @@
+package public
+
+import "testing"
+
+// TestShrinkConnsOutsideLock shrink 在 registry 的锁之外调用: 其中 Add/Remove 不会死锁, 所有连接都被缩小
+func TestShrinkConnsOutsideLock(t *testing.T) {
+	registry := NewRegistry[int]()
+	total := 2*registryChunk + 10
+	for i := range total {
+		registry.Add(i, &Peer{})
+	}
+	shrunk := make(map[int]int)
+	g := &MemoryGuard[int]{registry: registry, shrink: func(conn, size int) {
+		if size != shrunkBufferSize {
+			t.Fatalf("shrink size = %d, want %d", size, shrunkBufferSize)
+		}
+		shrunk[conn] = size
+		// 事件循环在缩小期间建立和关闭连接
+		registry.Add(-conn-1, &Peer{})
+		registry.Remove(-conn - 1)
+	}}
+	g.shrinkConns()
+	for i := range total {
+		if _, ok := shrunk[i]; !ok {
+			t.Fatalf("conn %d not shrunk, shrunk %d of %d", i, len(shrunk), total)
+		}
+	}
+}
@@ -1,6 +1,46 @@
 package public
 
+import (
+	"encoding/json"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// maxOneWayLatency 超过它的单向延迟视为两端时钟偏差或者客户端时间错误, 不计入 Latency
+const maxOneWayLatency = time.Minute
+
 type Msg struct {
-	Id int   `json:"id"`
-	Ts int64 `json:"ts"`
+	Id int `json:"id"`
+	// Ts 客户端发送时间, unix 纳秒. 服务端原样回传, 客户端据此计算 RTT
+	Ts int64 `json:"ts_ns"`
+}
+
+// ObserveLatency 记录从客户端发送到服务端收到的单向延迟. 两端时钟不同, 结果包含时钟偏差:
+// 负值或超过 maxOneWayLatency 的样本只计入 LatencySkewed, 真实的往返时间见客户端的 RTT
+func ObserveLatency(sentNs int64, now time.Time) {
+	if sentNs == 0 {
+		LatencySkewed.WithLabelValues("missing").Inc()
+		return
+	}
+	d := now.Sub(time.Unix(0, sentNs))
+	switch {
+	case d < 0:
+		LatencySkewed.WithLabelValues("negative").Inc()
+	case d > maxOneWayLatency:
+		LatencySkewed.WithLabelValues("too_large").Inc()
+	default:
+		Latency.Observe(d.Seconds())
+	}
+}
+
+// observeMsgLatency 解析 body 中的 Msg 并记录延迟
+func observeMsgLatency(body []byte) (Msg, bool) {
+	var msg Msg
+	if err := json.Unmarshal(body, &msg); err != nil {
+		Logger.Info("unmarshal failed", zap.Error(err))
+		return msg, false
+	}
+	ObserveLatency(msg.Ts, time.Now())
+	return msg, true
 }
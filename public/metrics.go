@@ -1,35 +1,303 @@
 package public
 
 import (
-	"net/http"
+	"os"
+	"slices"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"go.uber.org/zap"
 )
 
-var addr = ":8112"
+//go:generate go run ../gendashboard -out ../grafana-dashboard.json
 
+// 指标在包初始化时定义, 先记录在 pending 中, InitMetrics 确定 backend 之后再注册到 registry,
+// 这样所有指标(包括 Go runtime 与进程指标)都带上 backend/instance 常量标签, 多个 backend 可以共用一个 Prometheus
 var (
-	ConnectionCount = promauto.NewGauge(prometheus.GaugeOpts{
+	registry = prometheus.NewRegistry()
+	pending  = &pendingRegisterer{}
+	factory  = &metricFactory{Factory: promauto.With(pending)}
+)
+
+// MetricType 指标类型, 见 MetricDef
+type MetricType string
+
+const (
+	MetricCounter   MetricType = "counter"
+	MetricGauge     MetricType = "gauge"
+	MetricHistogram MetricType = "histogram"
+)
+
+// MetricDef 一个指标的定义, 不含 backend/instance 常量标签. gendashboard 据此生成 grafana-dashboard.json
+type MetricDef struct {
+	Name   string
+	Help   string
+	Type   MetricType
+	Labels []string
+}
+
+// MetricDefs 按定义顺序返回本包定义的所有指标, 不含 Go runtime 与进程指标
+func MetricDefs() []MetricDef {
+	return slices.Clone(factory.defs)
+}
+
+// metricFactory 在 promauto.Factory 的基础上记录每个指标的定义
+type metricFactory struct {
+	promauto.Factory
+	defs []MetricDef
+}
+
+func (f *metricFactory) NewCounter(opts prometheus.CounterOpts) prometheus.Counter {
+	f.defs = append(f.defs, MetricDef{Name: opts.Name, Help: opts.Help, Type: MetricCounter})
+	return f.Factory.NewCounter(opts)
+}
+
+func (f *metricFactory) NewCounterVec(opts prometheus.CounterOpts, labels []string) *prometheus.CounterVec {
+	f.defs = append(f.defs, MetricDef{Name: opts.Name, Help: opts.Help, Type: MetricCounter, Labels: labels})
+	return f.Factory.NewCounterVec(opts, labels)
+}
+
+func (f *metricFactory) NewGauge(opts prometheus.GaugeOpts) prometheus.Gauge {
+	f.defs = append(f.defs, MetricDef{Name: opts.Name, Help: opts.Help, Type: MetricGauge})
+	return f.Factory.NewGauge(opts)
+}
+
+func (f *metricFactory) NewGaugeVec(opts prometheus.GaugeOpts, labels []string) *prometheus.GaugeVec {
+	f.defs = append(f.defs, MetricDef{Name: opts.Name, Help: opts.Help, Type: MetricGauge, Labels: labels})
+	return f.Factory.NewGaugeVec(opts, labels)
+}
+
+func (f *metricFactory) NewHistogram(opts prometheus.HistogramOpts) prometheus.Histogram {
+	f.defs = append(f.defs, MetricDef{Name: opts.Name, Help: opts.Help, Type: MetricHistogram})
+	return f.Factory.NewHistogram(opts)
+}
+
+func (f *metricFactory) NewHistogramVec(opts prometheus.HistogramOpts, labels []string) *prometheus.HistogramVec {
+	f.defs = append(f.defs, MetricDef{Name: opts.Name, Help: opts.Help, Type: MetricHistogram, Labels: labels})
+	return f.Factory.NewHistogramVec(opts, labels)
+}
+
+type pendingRegisterer struct {
+	collectors []prometheus.Collector
+}
+
+func (r *pendingRegisterer) Register(c prometheus.Collector) error {
+	r.collectors = append(r.collectors, c)
+	return nil
+}
+
+func (r *pendingRegisterer) MustRegister(cs ...prometheus.Collector) {
+	r.collectors = append(r.collectors, cs...)
+}
+
+func (r *pendingRegisterer) Unregister(prometheus.Collector) bool {
+	return false
+}
+
+// InitMetrics 注册所有指标, backend 为服务端的名称(如 s2_epoll), instance 为主机名(k8s 中即 pod 名).
+// 需要在 Admin.Start 之前调用, 只能调用一次
+func InitMetrics(backend string) {
+	instance, err := os.Hostname()
+	if err != nil {
+		Logger.Warn("get hostname failed", zap.Error(err))
+	}
+	r := prometheus.WrapRegistererWith(prometheus.Labels{"backend": backend, "instance": instance}, registry)
+	r.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	r.MustRegister(pending.collectors...)
+	Logger.Info("metrics initialized", zap.String("backend", backend), zap.String("instance", instance))
+}
+
+var (
+	ConnectionCount = factory.NewGauge(prometheus.GaugeOpts{
 		Name: "connections",
 		Help: "The total number of connections",
 	})
-	RequestCount = promauto.NewCounter(prometheus.CounterOpts{
+	ConnectionCloses = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "connection_closes",
+		Help: "The total number of closed connections by reason: eof, reset, protocol_error, timeout, write_error, rate_limit, shed or other",
+	}, []string{"reason"})
+	AcceptErrors = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "accept_errors",
+		Help: "The total number of failed accepts by reason: fd_exhausted, aborted, no_memory or other",
+	}, []string{"reason"})
+	BytesIn = factory.NewCounter(prometheus.CounterOpts{
+		Name: "bytes_in",
+		Help: "The total number of bytes of received frames, including headers",
+	})
+	BytesOut = factory.NewCounter(prometheus.CounterOpts{
+		Name: "bytes_out",
+		Help: "The total number of bytes of sent frames, including headers",
+	})
+	FramesIn = factory.NewCounter(prometheus.CounterOpts{
+		Name: "frames_in",
+		Help: "The total number of received frames, including heartbeats",
+	})
+	FramesOut = factory.NewCounter(prometheus.CounterOpts{
+		Name: "frames_out",
+		Help: "The total number of sent frames, including heartbeats",
+	})
+	RequestCount = factory.NewCounter(prometheus.CounterOpts{
 		Name: "ops",
 		Help: "The total number of processed events",
 	})
-	Latency = promauto.NewHistogram(prometheus.HistogramOpts{
-		Name:    "latency",
-		Buckets: []float64{10, 50, 100, 200, 500, 1000},
+	// Latency 同时提供经典桶(50us ~ 1.6s)与原生直方图, 抓取端开启原生直方图时可以看到更细的分布
+	Latency = factory.NewHistogram(prometheus.HistogramOpts{
+		Name:                            "latency_seconds",
+		Help:                            "One-way latency from the client send timestamp to server receipt, includes clock skew between hosts",
+		Buckets:                         prometheus.ExponentialBuckets(0.00005, 2, 16),
+		NativeHistogramBucketFactor:     1.1,
+		NativeHistogramMaxBucketNumber:  160,
+		NativeHistogramMinResetDuration: time.Hour,
+	})
+	LatencySkewed = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "latency_skewed_samples",
+		Help: "The total number of latency samples not observed by reason: negative, too_large (clock skew) or missing timestamp",
+	}, []string{"reason"})
+	HeartbeatRTT = factory.NewHistogram(prometheus.HistogramOpts{
+		Name:    "heartbeat_rtt_seconds",
+		Help:    "Round-trip time of server-initiated heartbeats",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+	})
+	HeartbeatEvictions = factory.NewCounter(prometheus.CounterOpts{
+		Name: "heartbeat_evictions",
+		Help: "The total number of connections evicted by missed heartbeats",
+	})
+	ThrottleEvents = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "throttle_events",
+		Help: "The total number of rate limited frames by action",
+	}, []string{"action"})
+	RejectedConnections = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "rejected_connections",
+		Help: "The total number of connections rejected by admission control by reason",
+	}, []string{"reason"})
+	MemoryUsageRatio = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "memory_usage_ratio",
+		Help: "Memory usage relative to the detected memory limit",
+	})
+	MemoryStageGauge = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "memory_stage",
+		Help: "Current memory pressure stage: 0 normal, 1 stop_accept, 2 shrink, 3 shed",
+	})
+	MemoryStageTransitions = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "memory_stage_transitions",
+		Help: "The total number of memory stage transitions by target stage",
+	}, []string{"stage"})
+	MemoryShedConnections = factory.NewCounter(prometheus.CounterOpts{
+		Name: "memory_shed_connections",
+		Help: "The total number of connections closed under memory pressure",
+	})
+	CertExpiry = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "cert_expiry_timestamp_seconds",
+		Help: "Expiry time of the currently served certificate of each tenant in unix seconds",
+	}, []string{"tenant"})
+	HandshakeDuration = factory.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "tls_handshake_duration_seconds",
+		Help:    "Duration of server side tls handshakes by tenant and mode: full or resumed",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+	}, []string{"tenant", "mode"})
+	HandshakeQueueDepth = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "tls_handshake_queue_depth",
+		Help: "The number of connections waiting for a tls handshake worker",
 	})
+	HandshakeInFlight = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "tls_handshakes_in_flight",
+		Help: "The number of tls handshakes in progress",
+	})
+	HandshakeWaiting = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "tls_handshakes_waiting",
+		Help: "The number of tls handshakes that waited for the next record of the client and no longer hold a handshake worker",
+	})
+	HandshakeWorkers = factory.NewGauge(prometheus.GaugeOpts{
+		Name: "tls_handshake_workers",
+		Help: "The number of tls handshake workers",
+	})
+	HandshakeTimeouts = factory.NewCounter(prometheus.CounterOpts{
+		Name: "tls_handshake_timeouts",
+		Help: "The total number of tls handshakes aborted by the handshake deadline",
+	})
+	HandshakeFailures = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "tls_handshake_failures",
+		Help: "The total number of failed tls handshakes by alert type",
+	}, []string{"alert"})
+	TenantConnections = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "tenant_connections",
+		Help: "The number of established tls connections by tenant (SNI) and ALPN protocol",
+	}, []string{"tenant", "protocol"})
+	TenantRequests = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "tenant_ops",
+		Help: "The total number of data frames handled by tenant (SNI) and ALPN protocol",
+	}, []string{"tenant", "protocol"})
+	PollerFds = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "poller_registered_fds",
+		Help: "The number of connections registered in each epoll poller or gnet event loop",
+	}, []string{"poller"})
+	PollerWaits = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "poller_wait_iterations",
+		Help: "The total number of EpollWait calls of each poller",
+	}, []string{"poller"})
+	PollerEvents = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "poller_events",
+		Help: "The total number of events returned by EpollWait of each poller, or OnTraffic calls of each gnet event loop",
+	}, []string{"poller"})
+	PollerHandlerSeconds = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "poller_handler_seconds",
+		Help: "The total time each poller spent handling events",
+	}, []string{"poller"})
+	PollerBlockedSeconds = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "poller_blocked_seconds",
+		Help: "The total time each poller spent blocked in EpollWait",
+	}, []string{"poller"})
+	PollerMaxBatch = factory.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "poller_max_batch",
+		Help: "The max number of events returned by one EpollWait of each poller in the last 10 seconds",
+	}, []string{"poller"})
+	LogsDropped = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "log_messages_dropped",
+		Help: "The total number of log messages dropped by the sampler by level",
+	}, []string{"level"})
+	ProfileSnapshots = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "profile_snapshots",
+		Help: "The total number of watchdog profile snapshots by trigger reason: rss, goroutines, gc_pause or p99_latency",
+	}, []string{"reason"})
+	// TCP_INFO 采样, 见 TCPInfoSampler. 每次采样一个连接, 各直方图的 _count 相同
+	TCPRTT = factory.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tcp_rtt_seconds",
+		Help:    "Smoothed round-trip time estimated by the kernel of sampled connections",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+	})
+	TCPRTTVar = factory.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tcp_rtt_variance_seconds",
+		Help:    "Round-trip time variance estimated by the kernel of sampled connections",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 2, 16),
+	})
+	TCPRetransmits = factory.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tcp_retransmits",
+		Help:    "Total retransmitted segments over the lifetime of sampled connections",
+		Buckets: append([]float64{0}, prometheus.ExponentialBuckets(1, 2, 12)...),
+	})
+	TCPCwnd = factory.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tcp_snd_cwnd_segments",
+		Help:    "Congestion window in segments of sampled connections",
+		Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+	})
+	TCPUnacked = factory.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tcp_unacked_segments",
+		Help:    "Sent but unacknowledged segments of sampled connections",
+		Buckets: append([]float64{0}, prometheus.ExponentialBuckets(1, 2, 12)...),
+	})
+	TCPSendQueue = factory.NewHistogram(prometheus.HistogramOpts{
+		Name:    "tcp_send_queue_bytes",
+		Help:    "Bytes in the socket send queue not yet acknowledged by the peer of sampled connections",
+		Buckets: append([]float64{0}, prometheus.ExponentialBuckets(1024, 4, 10)...),
+	})
+	TCPInfoErrors = factory.NewCounter(prometheus.CounterOpts{
+		Name: "tcp_info_sample_errors",
+		Help: "The total number of failed TCP_INFO samples",
+	})
+	KTLSOffload = factory.NewCounterVec(prometheus.CounterOpts{
+		Name: "ktls_offload",
+		Help: "The total number of kTLS offload attempts by result: offloaded, fallback or failed",
+	}, []string{"result"})
 )
-
-func ServeMetrics() {
-	http.Handle("/metrics", promhttp.Handler())
-	Logger.Info("Serving metrics at /metrics", zap.String("addr", addr))
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		panic(err)
-	}
-}
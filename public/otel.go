@@ -0,0 +1,190 @@
+package public
+
+import (
+	"context"
+	"errors"
+	"os"
+	"server_millionclient/public/protocol"
+	"time"
+
+	prometheusbridge "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// otelShutdownTimeout 退出时导出剩余 span 和最后一次指标的最长时间
+const otelShutdownTimeout = 5 * time.Second
+
+// tracer InitOTel 之前为 nil, 此时 StartFrameTrace 只去掉 trace context 扩展, 不创建 span
+var tracer trace.Tracer
+
+// tracerProvider/meterProvider InitOTel 创建, 供 FlushOTel 使用; 没有导出时为 nil
+var (
+	tracerProvider *sdktrace.TracerProvider
+	meterProvider  *sdkmetric.MeterProvider
+)
+
+// OTelConfig OTLP/HTTP 导出配置
+type OTelConfig struct {
+	// Endpoint collector 地址, 如 http://127.0.0.1:4318, 为空时不导出
+	Endpoint string
+	// Service 即 service.name, 服务端为 backend 名称(与 InitMetrics 相同), 客户端为 client
+	Service string
+	// Metrics 是否导出 registry 中的指标, 客户端没有指标
+	Metrics bool
+	// Interval 导出指标的间隔
+	Interval time.Duration
+	// Ratio 没有收到对端 trace context 的帧按此比例采样, 收到时跟随对端的采样决定
+	Ratio float64
+}
+
+// InitOTel 通过 OTLP/HTTP 导出 registry 中的指标(与 /metrics 相同)和帧的 span.
+// 返回的 shutdown 在退出时调用, 导出剩余数据; Endpoint 为空时什么都不做
+func InitOTel(cfg OTelConfig) (shutdown func(), err error) {
+	if cfg.Endpoint == "" {
+		return func() {}, nil
+	}
+	instance, err := os.Hostname()
+	if err != nil {
+		Logger.Warn("get hostname failed", zap.Error(err))
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", cfg.Service),
+		attribute.String("service.instance.id", instance),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	traceExp, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+	if err != nil {
+		return nil, err
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithResource(res),
+		sdktrace.WithBatcher(traceExp),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.Ratio))),
+	)
+	otel.SetTracerProvider(tp)
+	tracer = tp.Tracer("server_millionclient")
+
+	var mp *sdkmetric.MeterProvider
+	if cfg.Metrics {
+		metricExp, err := otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpointURL(cfg.Endpoint))
+		if err != nil {
+			_ = tp.Shutdown(ctx)
+			return nil, err
+		}
+		reader := sdkmetric.NewPeriodicReader(metricExp, sdkmetric.WithInterval(cfg.Interval),
+			sdkmetric.WithProducer(prometheusbridge.NewMetricProducer(prometheusbridge.WithGatherer(registry))))
+		mp = sdkmetric.NewMeterProvider(sdkmetric.WithResource(res), sdkmetric.WithReader(reader))
+		otel.SetMeterProvider(mp)
+	}
+	tracerProvider, meterProvider = tp, mp
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		Logger.Warn("otel export failed", zap.Error(err))
+	}))
+	Logger.Info("otel initialized", zap.String("endpoint", cfg.Endpoint), zap.String("service", cfg.Service),
+		zap.Bool("metrics", cfg.Metrics), zap.Float64("ratio", cfg.Ratio))
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), otelShutdownTimeout)
+		defer cancel()
+		err := tp.Shutdown(ctx)
+		if mp != nil {
+			err = errors.Join(err, mp.Shutdown(ctx))
+		}
+		if err != nil {
+			Logger.Warn("otel shutdown failed", zap.Error(err))
+			return
+		}
+		Logger.Info("otel stopped")
+	}, nil
+}
+
+// FlushOTel 立即导出缓冲中的 span 和一次指标, 之后仍然继续导出. 收到退出信号时调用:
+// drain 可能持续到进程被强制结束, 等不到 InitOTel 返回的 shutdown
+func FlushOTel() {
+	if tracerProvider == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), otelShutdownTimeout)
+	defer cancel()
+	err := tracerProvider.ForceFlush(ctx)
+	if meterProvider != nil {
+		err = errors.Join(err, meterProvider.ForceFlush(ctx))
+	}
+	if err != nil {
+		Logger.Warn("otel flush failed", zap.Error(err))
+	}
+}
+
+// FrameTrace 一个被采样的帧在服务端的 span: frame 覆盖整个处理过程, 其下依次是 decode, handle, write 三个阶段.
+// nil 表示不采样, 方法都可以在 nil 上调用
+type FrameTrace struct {
+	ctx   context.Context
+	frame trace.Span
+	stage trace.Span
+}
+
+// StartFrameTrace 在 protocol.Read 之后调用, start 为开始读取该帧的时间, 作为 frame 与 decode 的开始时间.
+// 返回去掉 trace context 扩展之后的 body; 帧带有扩展时以对端的 span 为父 span, 否则按 OTelConfig.Ratio 采样
+func StartFrameTrace(header protocol.Header, body []byte, start time.Time) (*FrameTrace, []byte, error) {
+	tc, body, ok, err := protocol.SplitTraceContext(header, body)
+	if err != nil || tracer == nil || header.Type&^protocol.FlagTraceContext != protocol.TypeData {
+		return nil, body, err
+	}
+	ctx := context.Background()
+	if ok {
+		ctx = trace.ContextWithRemoteSpanContext(ctx, trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    tc.TraceID,
+			SpanID:     tc.SpanID,
+			TraceFlags: trace.TraceFlags(tc.Flags),
+			Remote:     true,
+		}))
+	}
+	ctx, frame := tracer.Start(ctx, "frame", trace.WithSpanKind(trace.SpanKindServer), trace.WithTimestamp(start),
+		trace.WithAttributes(attribute.Int("frame.bytes", protocol.HeaderSize+int(header.Len))))
+	if !frame.IsRecording() {
+		return nil, body, nil
+	}
+	_, decode := tracer.Start(ctx, "decode", trace.WithTimestamp(start))
+	t := &FrameTrace{ctx: ctx, frame: frame, stage: decode}
+	t.Stage("handle")
+	return t, body, nil
+}
+
+// Stage 结束当前阶段, 开始下一个阶段
+func (t *FrameTrace) Stage(name string) {
+	if t == nil {
+		return
+	}
+	t.stage.End()
+	_, t.stage = tracer.Start(t.ctx, name)
+}
+
+// End 结束当前阶段和 frame
+func (t *FrameTrace) End() {
+	if t == nil {
+		return
+	}
+	t.stage.End()
+	t.frame.End()
+}
+
+// TraceContextOf 把客户端 span 的 trace context 转换为帧头扩展, 未采样时返回 nil, 此时不需要发送扩展
+func TraceContextOf(span trace.Span) *protocol.TraceContext {
+	sc := span.SpanContext()
+	if !sc.IsSampled() {
+		return nil
+	}
+	return &protocol.TraceContext{TraceID: sc.TraceID(), SpanID: sc.SpanID(), Flags: byte(sc.TraceFlags())}
+}
@@ -0,0 +1,101 @@
+package public
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http/httptest"
+	"server_millionclient/otlpsink/receiver"
+	"server_millionclient/public/protocol"
+	"slices"
+	"testing"
+	"time"
+
+	"go.uber.org/zap/zaptest"
+)
+
+// TestOTLPExport 通过 otlpsink 的 receiver 导出一个帧的 span 和指标, 检查服务端的 span 以帧头扩展中客户端的 span 为父 span
+func TestOTLPExport(t *testing.T) {
+	Logger = zaptest.NewLogger(t)
+	sink := receiver.New()
+	srv := httptest.NewServer(sink.Handler())
+	defer srv.Close()
+
+	InitMetrics("otel_test")
+	shutdown, err := InitOTel(OTelConfig{Endpoint: srv.URL, Service: "otel_test", Metrics: true, Interval: time.Hour})
+	if err != nil {
+		t.Fatalf("InitOTel: %v", err)
+	}
+	t.Cleanup(func() { tracer, tracerProvider, meterProvider = nil, nil, nil })
+
+	client := protocol.TraceContext{
+		TraceID: [16]byte{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+		SpanID:  [8]byte{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+		Flags:   1,
+	}
+	frame, err := protocol.PackTraced([]byte(`{"id":1}`), client)
+	if err != nil {
+		t.Fatalf("PackTraced: %v", err)
+	}
+	header, body, err := protocol.Read(bytes.NewReader(frame))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	ft, body, err := StartFrameTrace(header, body, time.Now())
+	if err != nil {
+		t.Fatalf("StartFrameTrace: %v", err)
+	}
+	if string(body) != `{"id":1}` {
+		t.Fatalf("body = %q, trace context extension not stripped", body)
+	}
+	if ft == nil {
+		t.Fatal("frame with a sampled client trace context was not traced")
+	}
+	ft.Stage("write")
+	ft.End()
+	RequestCount.Inc()
+
+	// 收到退出信号时立即导出, 不等 drain 之后的 shutdown
+	FlushOTel()
+	if !slices.ContainsFunc(sink.Spans(), func(s receiver.Span) bool { return s.Name == "frame" }) {
+		t.Fatalf("frame span not exported by FlushOTel, got %+v", sink.Spans())
+	}
+	if sink.Metrics()["ops"] == 0 {
+		t.Fatalf("metric ops not exported by FlushOTel, got %v", sink.Metrics())
+	}
+
+	// 退出时导出剩余的 span 和最后一次指标
+	shutdown()
+
+	var got *receiver.Span
+	for _, s := range sink.Spans() {
+		if s.Name == "frame" {
+			got = &s
+		}
+	}
+	if got == nil {
+		t.Fatalf("no frame span received, got %+v", sink.Spans())
+	}
+	if got.Service != "otel_test" {
+		t.Errorf("service = %q, want otel_test", got.Service)
+	}
+	if want := hex.EncodeToString(client.TraceID[:]); got.TraceID != want {
+		t.Errorf("trace id = %s, want the client's %s", got.TraceID, want)
+	}
+	if want := hex.EncodeToString(client.SpanID[:]); got.ParentID != want {
+		t.Errorf("parent span id = %s, want the client's span %s", got.ParentID, want)
+	}
+	stages := map[string]bool{}
+	for _, s := range sink.Spans() {
+		if s.TraceID == got.TraceID && s.ParentID == got.SpanID {
+			stages[s.Name] = true
+		}
+	}
+	for _, name := range []string{"decode", "handle", "write"} {
+		if !stages[name] {
+			t.Errorf("stage span %q missing under frame, got %v", name, stages)
+		}
+	}
+	if sink.Metrics()["ops"] == 0 {
+		t.Errorf("metric ops not exported, got %v", sink.Metrics())
+	}
+}
@@ -0,0 +1,120 @@
+package public
+
+import (
+	"reflect"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// pollerBatchWindow poller_max_batch 统计最大批次的窗口
+const pollerBatchWindow = 10 * time.Second
+
+// PollerStats 一个事件循环(Epoll 或 gnet event loop)的指标, 用于观察 SO_REUSEPORT 在各事件循环之间分配连接是否均匀.
+// 除 AddFds 外只能由事件循环自己的 goroutine 调用
+type PollerStats struct {
+	name       string
+	fds        prometheus.Gauge
+	iterations prometheus.Counter
+	events     prometheus.Counter
+	handler    prometheus.Counter
+	blocked    prometheus.Counter
+	maxBatch   prometheus.Gauge
+
+	windowStart time.Time
+	windowMax   int
+}
+
+func newPollerStats(poller string) *PollerStats {
+	return &PollerStats{
+		name:       poller,
+		fds:        PollerFds.WithLabelValues(poller),
+		iterations: PollerWaits.WithLabelValues(poller),
+		events:     PollerEvents.WithLabelValues(poller),
+		handler:    PollerHandlerSeconds.WithLabelValues(poller),
+		blocked:    PollerBlockedSeconds.WithLabelValues(poller),
+		maxBatch:   PollerMaxBatch.WithLabelValues(poller),
+	}
+}
+
+// Name poller 标签值, nil 时为空
+func (s *PollerStats) Name() string {
+	if s == nil {
+		return ""
+	}
+	return s.name
+}
+
+// SetFds 当前注册的连接数
+func (s *PollerStats) SetFds(n int) {
+	s.fds.Set(float64(n))
+}
+
+// AddFds 可以在任意 goroutine 中调用
+func (s *PollerStats) AddFds(delta int) {
+	s.fds.Add(float64(delta))
+}
+
+// Waited 一次 EpollWait 阻塞了 d, 返回 n 个事件. 只用于 newPollerStats 创建的 PollerStats
+func (s *PollerStats) Waited(n int, d time.Duration) {
+	s.iterations.Inc()
+	s.events.Add(float64(n))
+	s.blocked.Add(d.Seconds())
+
+	if now := time.Now(); now.Sub(s.windowStart) >= pollerBatchWindow {
+		s.windowStart, s.windowMax = now, n
+		s.maxBatch.Set(float64(n))
+	} else if n > s.windowMax {
+		s.windowMax = n
+		s.maxBatch.Set(float64(n))
+	}
+}
+
+// Handled 处理一批事件用了 d
+func (s *PollerStats) Handled(d time.Duration) {
+	s.handler.Add(d.Seconds())
+}
+
+// Traffic gnet 的一次 OnTraffic 回调, 计为一个事件
+func (s *PollerStats) Traffic(d time.Duration) {
+	s.events.Inc()
+	s.handler.Add(d.Seconds())
+}
+
+var loopStats sync.Map // int -> *PollerStats
+
+// LoopStats 返回 gnet 连接所属 event loop 的 PollerStats, 在 OnOpen 中调用一次并保存在 Peer.Loop 中
+func LoopStats(conn any) *PollerStats {
+	idx := gnetLoopIndex(conn)
+	if s, ok := loopStats.Load(idx); ok {
+		return s.(*PollerStats)
+	}
+	// gnet 不暴露 EpollWait, 只有连接数, 事件数和处理时间
+	poller := strconv.Itoa(idx)
+	s, _ := loopStats.LoadOrStore(idx, &PollerStats{
+		name:    poller,
+		fds:     PollerFds.WithLabelValues(poller),
+		events:  PollerEvents.WithLabelValues(poller),
+		handler: PollerHandlerSeconds.WithLabelValues(poller),
+	})
+	return s.(*PollerStats)
+}
+
+// gnetLoopIndex gnet 没有公开连接所属的 event loop, 与 netFD 一样通过反射读取 conn.loop.idx, 取不到时为 0
+func gnetLoopIndex(conn any) int {
+	v := reflect.Indirect(reflect.ValueOf(conn))
+	if v.Kind() != reflect.Struct {
+		return 0
+	}
+	loop := v.FieldByName("loop")
+	if loop.Kind() != reflect.Pointer || loop.IsNil() {
+		return 0
+	}
+	idx := loop.Elem().FieldByName("idx")
+	if idx.Kind() != reflect.Int {
+		return 0
+	}
+	return int(idx.Int())
+}
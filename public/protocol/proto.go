@@ -3,22 +3,56 @@ package protocol
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"time"
 )
 
 type Header struct {
 	Magic uint32
+	Type  FrameType
 	Len   uint32
 }
 
+// FrameType 帧类型
+type FrameType uint32
+
+const (
+	TypeData FrameType = iota
+	TypePing
+	TypePong
+)
+
+// FlagTraceContext Type 的最高位, 置位时 body 之前是 TraceContextSize 字节的 trace context 扩展, Len 包含扩展.
+// 只用于 data 帧, 由 SplitTraceContext 取出
+const FlagTraceContext FrameType = 1 << 31
+
+// TraceContextSize trace context 扩展的长度: trace id(16) + span id(8) + trace flags(1), 与 W3C traceparent 相同
+const TraceContextSize = 25
+
+// TraceContext 发送方 span 的 trace context, 接收方以它为父 span, 使两端的 span 串联在同一个 trace 中
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
 const MagicNumber = 0x12345678 // Header.Magic uint32, 即 4 个字节, 8 位十六进制数
 
 var HeaderSize = binary.Size(Header{})
 
+// ErrProtocol 对端发送的数据不符合协议(如 magic number 不对), 可以用 errors.Is 判断
+var ErrProtocol = errors.New("protocol error")
+
 // Pack 将 msg 封装成 Header + body
 func Pack(msg []byte) ([]byte, error) {
-	header := Header{Magic: MagicNumber, Len: uint32(len(msg))}
+	return PackFrame(TypeData, msg)
+}
+
+// PackFrame 将 msg 封装成指定类型的帧
+func PackFrame(typ FrameType, msg []byte) ([]byte, error) {
+	header := Header{Magic: MagicNumber, Type: typ, Len: uint32(len(msg))}
 
 	buf := new(bytes.Buffer)
 	buf.Grow(HeaderSize + len(msg))
@@ -32,6 +66,41 @@ func Pack(msg []byte) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
+// PackTraced 将 msg 封装成带有 trace context 扩展的 data 帧
+func PackTraced(msg []byte, tc TraceContext) ([]byte, error) {
+	ext := make([]byte, TraceContextSize, TraceContextSize+len(msg))
+	copy(ext, tc.TraceID[:])
+	copy(ext[16:], tc.SpanID[:])
+	ext[24] = tc.Flags
+	return PackFrame(TypeData|FlagTraceContext, append(ext, msg...))
+}
+
+// SplitTraceContext 从 Read 得到的 body 中去掉 trace context 扩展, 返回扩展和真正的 body.
+// 帧没有扩展时原样返回 body, ok 为 false
+func SplitTraceContext(header Header, body []byte) (tc TraceContext, msg []byte, ok bool, err error) {
+	if header.Type&FlagTraceContext == 0 {
+		return tc, body, false, nil
+	}
+	if len(body) < TraceContextSize {
+		return tc, nil, false, fmt.Errorf("%w: short trace context: %d", ErrProtocol, len(body))
+	}
+	copy(tc.TraceID[:], body)
+	copy(tc.SpanID[:], body[16:])
+	tc.Flags = body[24]
+	return tc, body[TraceContextSize:], true, nil
+}
+
+// FrameLen 根据帧头计算整帧长度(Header + body), 用于判断缓冲区中的帧是否完整
+func FrameLen(headerRaw []byte) (int, error) {
+	if len(headerRaw) < HeaderSize {
+		return 0, fmt.Errorf("short header: %d", len(headerRaw))
+	}
+	if magic := binary.BigEndian.Uint32(headerRaw); magic != MagicNumber {
+		return 0, fmt.Errorf("%w: illegal magic number: %d", ErrProtocol, magic)
+	}
+	return HeaderSize + int(binary.BigEndian.Uint32(headerRaw[HeaderSize-4:])), nil
+}
+
 // Read 从 reader 中读取数据并解析出 Header 和 body
 func Read(reader io.Reader) (Header, []byte, error) {
 	var header Header
@@ -43,7 +112,7 @@ func Read(reader io.Reader) (Header, []byte, error) {
 		return header, nil, fmt.Errorf("read header to struct err: %w", err)
 	}
 	if header.Magic != MagicNumber {
-		return header, nil, fmt.Errorf("illegal magic number: %d", header.Magic)
+		return header, nil, fmt.Errorf("%w: illegal magic number: %d", ErrProtocol, header.Magic)
 	}
 
 	body := make([]byte, header.Len)
@@ -52,3 +121,18 @@ func Read(reader io.Reader) (Header, []byte, error) {
 	}
 	return header, body, nil
 }
+
+// PackPing 生成 ping 帧, body 为发送时间(unix nano), 对端原样放在 pong 中返回
+func PackPing(now time.Time) ([]byte, error) {
+	body := make([]byte, 8)
+	binary.BigEndian.PutUint64(body, uint64(now.UnixNano()))
+	return PackFrame(TypePing, body)
+}
+
+// PingTime 从 ping/pong 的 body 中解析出 ping 的发送时间
+func PingTime(body []byte) (time.Time, bool) {
+	if len(body) != 8 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(body))), true
+}
@@ -0,0 +1,229 @@
+package public
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// HAProxy PROXY protocol, 见 https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+const (
+	proxyV1Prefix = "PROXY "
+	// proxyV1MaxLen v1 头的最大长度, 包括结尾的 \r\n
+	proxyV1MaxLen = 107
+	proxyV2Sig    = "\r\n\r\n\x00\r\nQUIT\n"
+	// proxyV2HeaderLen 签名(12) + ver_cmd(1) + fam(1) + len(2)
+	proxyV2HeaderLen = 16
+)
+
+// ErrNoProxyHeader 开启 PROXY protocol 后连接的开头不是 PROXY 头
+var ErrNoProxyHeader = errors.New("no proxy protocol header")
+
+// ProxyHeader 解析出的 PROXY protocol 头.
+// LOCAL 命令(负载均衡器自身的健康检查)或 v1 的 UNKNOWN 没有地址, Source/Destination 为 nil
+type ProxyHeader struct {
+	Version     int
+	Source      net.Addr
+	Destination net.Addr
+}
+
+// ParseProxyHeader 从 b 的开头解析 PROXY protocol v1/v2 头, 返回头的长度.
+// b 中的数据还不足以判断时返回 nil, 0, nil, 调用方应读入更多数据后重试
+func ParseProxyHeader(b []byte) (*ProxyHeader, int, error) {
+	switch {
+	case hasPrefix(b, proxyV2Sig):
+		if len(b) < proxyV2HeaderLen {
+			return nil, 0, nil
+		}
+		return parseProxyV2(b)
+	case hasPrefix(b, proxyV1Prefix):
+		if len(b) < len(proxyV1Prefix) {
+			return nil, 0, nil
+		}
+		return parseProxyV1(b)
+	}
+	return nil, 0, ErrNoProxyHeader
+}
+
+// hasPrefix b 以 prefix 开头, 或者 b 是 prefix 的前缀(数据还没收全)
+func hasPrefix(b []byte, prefix string) bool {
+	n := min(len(b), len(prefix))
+	return string(b[:n]) == prefix[:n]
+}
+
+// parseProxyV1 "PROXY TCP4 192.0.2.1 192.0.2.2 56324 443\r\n" 或 "PROXY UNKNOWN ...\r\n"
+func parseProxyV1(b []byte) (*ProxyHeader, int, error) {
+	end := bytes.Index(b[:min(len(b), proxyV1MaxLen)], []byte("\r\n"))
+	if end < 0 {
+		if len(b) >= proxyV1MaxLen {
+			return nil, 0, errors.New("proxy v1 header too long")
+		}
+		return nil, 0, nil
+	}
+	n := end + 2
+	fields := bytes.Split(b[:end], []byte(" "))
+	header := &ProxyHeader{Version: 1}
+	if len(fields) >= 2 && string(fields[1]) == "UNKNOWN" {
+		return header, n, nil
+	}
+	if len(fields) != 6 || (string(fields[1]) != "TCP4" && string(fields[1]) != "TCP6") {
+		return nil, 0, fmt.Errorf("illegal proxy v1 header: %q", b[:end])
+	}
+	src, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return nil, 0, err
+	}
+	dst, err := parseProxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return nil, 0, err
+	}
+	header.Source, header.Destination = src, dst
+	return header, n, nil
+}
+
+func parseProxyV1Addr(ip, port []byte) (net.Addr, error) {
+	addr := &net.TCPAddr{IP: net.ParseIP(string(ip))}
+	if addr.IP == nil {
+		return nil, fmt.Errorf("illegal proxy v1 address: %q", ip)
+	}
+	p, err := strconv.ParseUint(string(port), 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("illegal proxy v1 port: %q", port)
+	}
+	addr.Port = int(p)
+	return addr, nil
+}
+
+func parseProxyV2(b []byte) (*ProxyHeader, int, error) {
+	verCmd, fam := b[12], b[13]
+	if verCmd>>4 != 2 {
+		return nil, 0, fmt.Errorf("illegal proxy v2 version: %d", verCmd>>4)
+	}
+	n := proxyV2HeaderLen + int(binary.BigEndian.Uint16(b[14:16]))
+	if len(b) < n {
+		return nil, 0, nil
+	}
+	header := &ProxyHeader{Version: 2}
+	switch verCmd & 0xf {
+	case 0: // LOCAL
+		return header, n, nil
+	case 1: // PROXY
+	default:
+		return nil, 0, fmt.Errorf("illegal proxy v2 command: %d", verCmd&0xf)
+	}
+	// 地址之后的 TLV 忽略
+	addrs := b[proxyV2HeaderLen:n]
+	var ipLen int
+	switch fam >> 4 {
+	case 1: // AF_INET
+		ipLen = net.IPv4len
+	case 2: // AF_INET6
+		ipLen = net.IPv6len
+	default:
+		// AF_UNSPEC/AF_UNIX 没有可用的 IP 地址, 按 LOCAL 处理
+		return header, n, nil
+	}
+	if len(addrs) < 2*ipLen+4 {
+		return nil, 0, fmt.Errorf("short proxy v2 addresses: %d", len(addrs))
+	}
+	header.Source = &net.TCPAddr{
+		IP:   net.IP(bytes.Clone(addrs[:ipLen])),
+		Port: int(binary.BigEndian.Uint16(addrs[2*ipLen:])),
+	}
+	header.Destination = &net.TCPAddr{
+		IP:   net.IP(bytes.Clone(addrs[ipLen : 2*ipLen])),
+		Port: int(binary.BigEndian.Uint16(addrs[2*ipLen+2:])),
+	}
+	return header, n, nil
+}
+
+// AppendProxyHeader 按 version(1 或 2)生成 src -> dst 的 PROXY 头, 供 client 模拟负载均衡器
+func AppendProxyHeader(b []byte, version int, src, dst *net.TCPAddr) ([]byte, error) {
+	src4, dst4 := src.IP.To4(), dst.IP.To4()
+	ipv4 := src4 != nil && dst4 != nil
+	switch version {
+	case 1:
+		proto := "TCP6"
+		if ipv4 {
+			proto = "TCP4"
+		}
+		return fmt.Appendf(b, "PROXY %s %s %s %d %d\r\n", proto, src.IP, dst.IP, src.Port, dst.Port), nil
+	case 2:
+		b = append(b, proxyV2Sig...)
+		b = append(b, 0x21) // v2, PROXY
+		if ipv4 {
+			b = append(b, 0x11) // AF_INET, STREAM
+			b = binary.BigEndian.AppendUint16(b, 2*net.IPv4len+4)
+			b = append(append(b, src4...), dst4...)
+		} else {
+			b = append(b, 0x21) // AF_INET6, STREAM
+			b = binary.BigEndian.AppendUint16(b, 2*net.IPv6len+4)
+			b = append(append(b, src.IP.To16()...), dst.IP.To16()...)
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(src.Port))
+		return binary.BigEndian.AppendUint16(b, uint16(dst.Port)), nil
+	}
+	return nil, fmt.Errorf("unknown proxy protocol version: %d", version)
+}
+
+// ReadProxyHeader 供每个连接一个 goroutine 的 backend 使用: 阻塞读取 PROXY 头, 最多等待 timeout(为 0 时不限),
+// 连上之后不发送数据的客户端不会一直占用 goroutine 和准入名额. 成功后清除读超时.
+// 返回的连接先读出头之后已经收到的数据, 再读原始连接
+func ReadProxyHeader(conn net.Conn, timeout time.Duration) (*FeedConn, *ProxyHeader, error) {
+	if timeout > 0 {
+		if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return nil, nil, fmt.Errorf("set read deadline failed: %w", err)
+		}
+	}
+	feed := NewFeedConn(conn)
+	var buf [256]byte
+	var data []byte
+	for {
+		n, err := conn.Read(buf[:])
+		data = append(data, buf[:n]...)
+		header, size, parseErr := ParseProxyHeader(data)
+		if parseErr != nil {
+			return nil, nil, parseErr
+		}
+		if header != nil {
+			if timeout > 0 {
+				if err := conn.SetReadDeadline(time.Time{}); err != nil {
+					return nil, nil, fmt.Errorf("clear read deadline failed: %w", err)
+				}
+			}
+			feed.Feed(data[size:])
+			feed.Direct()
+			return feed, header, nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("read proxy header failed: %w", err)
+		}
+	}
+}
+
+// ReadProxyHeader 供事件循环使用: 从 Fill 读入的缓冲区中解析并消费 PROXY 头, 头还不完整时返回 nil, nil
+func (c *FeedConn) ReadProxyHeader() (*ProxyHeader, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	header, n, err := ParseProxyHeader(c.buf)
+	if header == nil || err != nil {
+		return nil, err
+	}
+	c.buf = c.buf[n:]
+	if len(c.buf) == 0 {
+		c.buf = nil
+	}
+	return header, nil
+}
+
+// ClientAddr 头中的原始客户端地址, 没有地址(LOCAL/UNKNOWN)时为 remote, 即连接的对端地址
+func (h *ProxyHeader) ClientAddr(remote net.Addr) net.Addr {
+	if h.Source != nil {
+		return h.Source
+	}
+	return remote
+}
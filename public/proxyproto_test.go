@@ -0,0 +1,261 @@
+package public
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// proxyV2 生成 v2 头, payload 为地址和 TLV
+func proxyV2(verCmd, fam byte, payload []byte) []byte {
+	b := append([]byte(proxyV2Sig), verCmd, fam)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(payload)))
+	return append(b, payload...)
+}
+
+// v4Addrs 192.0.2.1:56324 -> 198.51.100.2:443 的 v2 地址块
+var v4Addrs = []byte{192, 0, 2, 1, 198, 51, 100, 2, 0xdc, 0x04, 0x01, 0xbb}
+
+func TestParseProxyHeader(t *testing.T) {
+	v6Addrs := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0x30, 0x39, 0x00, 0x50)
+	// PP2_TYPE_AUTHORITY "example.com" 与 PP2_TYPE_NOOP
+	tlvs := append([]byte{0x02, 0x00, 0x0b}, "example.com"...)
+	tlvs = append(tlvs, 0x04, 0x00, 0x00)
+	tests := []struct {
+		name string
+		in   []byte
+		// wantLen 为 0 且 wantErr 为空时表示数据不足
+		wantLen int
+		wantSrc string
+		wantDst string
+		wantErr string
+	}{
+		{name: "empty", in: nil},
+		{name: "v1 prefix only", in: []byte("PRO")},
+		{name: "v1 truncated line", in: []byte("PROXY TCP4 192.0.2.1 198.51.100.2 56324")},
+		{
+			name:    "v1 tcp4",
+			in:      []byte("PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\npayload"),
+			wantLen: len("PROXY TCP4 192.0.2.1 198.51.100.2 56324 443\r\n"),
+			wantSrc: "192.0.2.1:56324",
+			wantDst: "198.51.100.2:443",
+		},
+		{
+			name:    "v1 tcp6",
+			in:      []byte("PROXY TCP6 2001:db8::1 2001:db8::2 12345 80\r\n"),
+			wantLen: len("PROXY TCP6 2001:db8::1 2001:db8::2 12345 80\r\n"),
+			wantSrc: "[2001:db8::1]:12345",
+			wantDst: "[2001:db8::2]:80",
+		},
+		{name: "v1 unknown", in: []byte("PROXY UNKNOWN\r\n"), wantLen: len("PROXY UNKNOWN\r\n")},
+		{name: "v1 unknown with addresses", in: []byte("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n"), wantLen: len("PROXY UNKNOWN ffff::1 ffff::2 1 2\r\n")},
+		{
+			// 规范中最长的 v1 头
+			name:    "v1 longest line",
+			in:      []byte("PROXY UNKNOWN ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff 65535 65535\r\n"),
+			wantLen: proxyV1MaxLen,
+		},
+		{name: "v1 oversized", in: []byte("PROXY TCP4 " + strings.Repeat("1", proxyV1MaxLen)), wantErr: "too long"},
+		{name: "v1 oversized with crlf after the limit", in: []byte("PROXY TCP4 " + strings.Repeat(" ", proxyV1MaxLen) + "\r\n"), wantErr: "too long"},
+		{name: "v1 unknown protocol", in: []byte("PROXY UDP4 192.0.2.1 198.51.100.2 1 2\r\n"), wantErr: "illegal proxy v1 header"},
+		{name: "v1 missing fields", in: []byte("PROXY TCP4 192.0.2.1 198.51.100.2 1\r\n"), wantErr: "illegal proxy v1 header"},
+		{name: "v1 bad address", in: []byte("PROXY TCP4 192.0.2.300 198.51.100.2 1 2\r\n"), wantErr: "illegal proxy v1 address"},
+		{name: "v1 bad port", in: []byte("PROXY TCP4 192.0.2.1 198.51.100.2 65536 2\r\n"), wantErr: "illegal proxy v1 port"},
+		{name: "v1 lowercase", in: []byte("proxy TCP4 192.0.2.1 198.51.100.2 1 2\r\n"), wantErr: ErrNoProxyHeader.Error()},
+		{name: "no header", in: []byte("GET / HTTP/1.1\r\n"), wantErr: ErrNoProxyHeader.Error()},
+		{name: "tls client hello", in: []byte{0x16, 0x03, 0x01, 0x00, 0xc8}, wantErr: ErrNoProxyHeader.Error()},
+		{name: "v2 signature prefix", in: []byte(proxyV2Sig[:5])},
+		{name: "v2 bad signature", in: []byte("\r\n\r\n\x00\r\nQUIT\r"), wantErr: ErrNoProxyHeader.Error()},
+		{name: "v2 truncated header", in: proxyV2(0x21, 0x11, v4Addrs)[:proxyV2HeaderLen-1]},
+		{name: "v2 truncated addresses", in: proxyV2(0x21, 0x11, v4Addrs)[:proxyV2HeaderLen+4]},
+		{
+			name:    "v2 tcp4",
+			in:      append(proxyV2(0x21, 0x11, v4Addrs), "payload"...),
+			wantLen: proxyV2HeaderLen + len(v4Addrs),
+			wantSrc: "192.0.2.1:56324",
+			wantDst: "198.51.100.2:443",
+		},
+		{
+			name:    "v2 tcp6",
+			in:      proxyV2(0x21, 0x21, v6Addrs),
+			wantLen: proxyV2HeaderLen + len(v6Addrs),
+			wantSrc: "[2001:db8::1]:12345",
+			wantDst: "[2001:db8::2]:80",
+		},
+		{
+			name:    "v2 tlvs after addresses",
+			in:      append(proxyV2(0x21, 0x11, append(v4Addrs[:len(v4Addrs):len(v4Addrs)], tlvs...)), "payload"...),
+			wantLen: proxyV2HeaderLen + len(v4Addrs) + len(tlvs),
+			wantSrc: "192.0.2.1:56324",
+			wantDst: "198.51.100.2:443",
+		},
+		{name: "v2 tlvs truncated", in: proxyV2(0x21, 0x11, append(v4Addrs[:len(v4Addrs):len(v4Addrs)], tlvs...))[:proxyV2HeaderLen+len(v4Addrs)+3]},
+		{name: "v2 local", in: proxyV2(0x20, 0x00, nil), wantLen: proxyV2HeaderLen},
+		{name: "v2 local ignores addresses", in: proxyV2(0x20, 0x11, v4Addrs), wantLen: proxyV2HeaderLen + len(v4Addrs)},
+		{name: "v2 unspec family", in: proxyV2(0x21, 0x00, nil), wantLen: proxyV2HeaderLen},
+		{name: "v2 unix family", in: proxyV2(0x21, 0x31, make([]byte, 216)), wantLen: proxyV2HeaderLen + 216},
+		{name: "v2 short addresses", in: proxyV2(0x21, 0x11, v4Addrs[:8]), wantErr: "short proxy v2 addresses"},
+		{name: "v2 bad version", in: proxyV2(0x11, 0x11, v4Addrs), wantErr: "illegal proxy v2 version"},
+		{name: "v2 bad command", in: proxyV2(0x22, 0x11, v4Addrs), wantErr: "illegal proxy v2 command"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header, n, err := ParseProxyHeader(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected err: %v", err)
+			}
+			if tt.wantLen == 0 {
+				if header != nil || n != 0 {
+					t.Fatalf("got header %+v, n = %d for incomplete data", header, n)
+				}
+				return
+			}
+			if header == nil || n != tt.wantLen {
+				t.Fatalf("header = %+v, n = %d, want n = %d", header, n, tt.wantLen)
+			}
+			if got := addrString(header.Source); got != tt.wantSrc {
+				t.Errorf("source = %q, want %q", got, tt.wantSrc)
+			}
+			if got := addrString(header.Destination); got != tt.wantDst {
+				t.Errorf("destination = %q, want %q", got, tt.wantDst)
+			}
+		})
+	}
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// TestProxyHeaderRoundTrip AppendProxyHeader 生成的头能被 ParseProxyHeader 解析回相同的地址
+func TestProxyHeaderRoundTrip(t *testing.T) {
+	pairs := []struct{ src, dst *net.TCPAddr }{
+		{&net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 8000}},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 40000}, &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 8000}},
+	}
+	for _, version := range []int{1, 2} {
+		for _, p := range pairs {
+			b, err := AppendProxyHeader(nil, version, p.src, p.dst)
+			if err != nil {
+				t.Fatalf("v%d %s: %v", version, p.src, err)
+			}
+			header, n, err := ParseProxyHeader(b)
+			if err != nil || header == nil || n != len(b) {
+				t.Fatalf("v%d %s: header = %+v, n = %d/%d, err = %v", version, p.src, header, n, len(b), err)
+			}
+			if header.Version != version || header.Source.String() != p.src.String() || header.Destination.String() != p.dst.String() {
+				t.Errorf("v%d: got %+v, want %s -> %s", version, header, p.src, p.dst)
+			}
+		}
+	}
+	if _, err := AppendProxyHeader(nil, 3, pairs[0].src, pairs[0].dst); err == nil {
+		t.Error("version 3 accepted")
+	}
+}
+
+// TestFeedConnReadProxyHeader 事件循环逐字节喂入时, 头完整之前返回 nil, 头之后的数据留在缓冲区
+func TestFeedConnReadProxyHeader(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	feed := NewFeedConn(server)
+	defer feed.Close()
+
+	data := append(proxyV2(0x21, 0x11, v4Addrs), "frame"...)
+	for i, c := range data[:proxyV2HeaderLen+len(v4Addrs)-1] {
+		feed.Feed([]byte{c})
+		if header, err := feed.ReadProxyHeader(); header != nil || err != nil {
+			t.Fatalf("byte %d: header = %+v, err = %v before the header is complete", i, header, err)
+		}
+	}
+	feed.Feed(data[proxyV2HeaderLen+len(v4Addrs)-1:])
+	header, err := feed.ReadProxyHeader()
+	if err != nil || header == nil {
+		t.Fatalf("header = %+v, err = %v", header, err)
+	}
+	if got := header.ClientAddr(server.RemoteAddr()).String(); got != "192.0.2.1:56324" {
+		t.Errorf("client addr = %s", got)
+	}
+	if feed.Buffered() != len("frame") {
+		t.Errorf("buffered = %d, want the %d bytes after the header", feed.Buffered(), len("frame"))
+	}
+
+	local := NewFeedConn(server)
+	local.Feed(proxyV2(0x20, 0x00, nil))
+	header, err = local.ReadProxyHeader()
+	if err != nil || header == nil {
+		t.Fatalf("local: header = %+v, err = %v", header, err)
+	}
+	if header.ClientAddr(server.RemoteAddr()) != server.RemoteAddr() {
+		t.Error("LOCAL header did not fall back to the connection's remote address")
+	}
+}
+
+func TestReadProxyHeaderErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		in   string
+		want error
+	}{
+		{name: "no header", in: "hello world\r\n", want: ErrNoProxyHeader},
+		{name: "eof mid header", in: "PROXY TCP4 192.0.2.1"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			go func() {
+				_, _ = client.Write([]byte(tt.in))
+				_ = client.Close()
+			}()
+			_, _, err := ReadProxyHeader(server, 0)
+			if err == nil {
+				t.Fatal("err = nil")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Fatalf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+// TestReadProxyHeaderTimeout 连上之后不发送 PROXY 头的客户端在 timeout 之后被拒绝, 成功读出头之后不再有读期限
+func TestReadProxyHeaderTimeout(t *testing.T) {
+	server, _ := tcpPair(t)
+	start := time.Now()
+	_, _, err := ReadProxyHeader(server, 50*time.Millisecond)
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("err = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("returned after %v", elapsed)
+	}
+
+	server, client := tcpPair(t)
+	if _, err := client.Write([]byte("PROXY TCP4 192.0.2.1 192.0.2.2 1234 80\r\n")); err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	feed, _, err := ReadProxyHeader(server, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("ReadProxyHeader: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatalf("client write: %v", err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(feed, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("read after the header = %q, %v", buf, err)
+	}
+}
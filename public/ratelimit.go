@@ -0,0 +1,170 @@
+package public
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = errors.New("rate limited")
+
+// RateLimitAction 超限后的处理方式
+type RateLimitAction int
+
+const (
+	// RateLimitDelay 放行当前帧, 暂停读取该连接直到令牌补足
+	RateLimitDelay RateLimitAction = iota
+	// RateLimitDrop 丢弃当前帧, 不回复
+	RateLimitDrop
+	// RateLimitClose 关闭连接
+	RateLimitClose
+)
+
+func ParseRateLimitAction(s string) (RateLimitAction, error) {
+	switch s {
+	case "delay":
+		return RateLimitDelay, nil
+	case "drop":
+		return RateLimitDrop, nil
+	case "close":
+		return RateLimitClose, nil
+	}
+	return RateLimitDelay, fmt.Errorf("unknown rate limit action: %s", s)
+}
+
+func (a RateLimitAction) String() string {
+	switch a {
+	case RateLimitDrop:
+		return "drop"
+	case RateLimitClose:
+		return "close"
+	}
+	return "delay"
+}
+
+// RateLimitConfig 各项为每秒速率, 0 表示不限制
+type RateLimitConfig struct {
+	ConnFrames   float64
+	ConnBytes    float64
+	GlobalFrames float64
+	GlobalBytes  float64
+	Action       RateLimitAction
+}
+
+// RateLimiter 令牌桶限速, 每个连接各自一组桶(存放在 Peer 中), 所有连接再共享一组全局桶.
+// 桶容量为 1 秒的速率
+type RateLimiter struct {
+	cfg RateLimitConfig
+
+	lock         sync.Mutex
+	globalFrames tokenBucket
+	globalBytes  tokenBucket
+}
+
+func NewRateLimiter(cfg RateLimitConfig) *RateLimiter {
+	return &RateLimiter{cfg: cfg}
+}
+
+func (l *RateLimiter) enabled() bool {
+	return l.cfg.ConnFrames > 0 || l.cfg.ConnBytes > 0 || l.cfg.GlobalFrames > 0 || l.cfg.GlobalBytes > 0
+}
+
+// Limit 检查连接上刚读到的一帧(frameLen 为整帧字节数).
+// 返回 err 时应关闭连接; drop 为 true 时丢弃该帧; delay 模式下超限时设置 peer.ResumeAt,
+// 调用方处理完该帧后应暂停读取该连接直到 ResumeAt.
+// 同一连接的 Limit 只能在一个 goroutine 中调用
+func (l *RateLimiter) Limit(peer *Peer, frameLen int) (drop bool, err error) {
+	if !l.enabled() {
+		return false, nil
+	}
+	now := time.Now()
+	n := float64(frameLen)
+
+	if l.cfg.Action == RateLimitDelay {
+		wait := max(peer.frames.reserve(l.cfg.ConnFrames, 1, now), peer.bytes.reserve(l.cfg.ConnBytes, n, now))
+		l.lock.Lock()
+		wait = max(wait, l.globalFrames.reserve(l.cfg.GlobalFrames, 1, now), l.globalBytes.reserve(l.cfg.GlobalBytes, n, now))
+		l.lock.Unlock()
+		if wait > 0 {
+			peer.ResumeAt = now.Add(wait)
+			ThrottleEvents.WithLabelValues(l.cfg.Action.String()).Inc()
+		}
+		return false, nil
+	}
+
+	// 所有桶都有足够的令牌时才一起扣除, 被拒绝的帧不消耗任何桶的令牌
+	allowed := peer.frames.has(l.cfg.ConnFrames, 1, now) && peer.bytes.has(l.cfg.ConnBytes, n, now)
+	if allowed {
+		l.lock.Lock()
+		allowed = l.globalFrames.has(l.cfg.GlobalFrames, 1, now) && l.globalBytes.has(l.cfg.GlobalBytes, n, now)
+		if allowed {
+			l.globalFrames.take(l.cfg.GlobalFrames, 1)
+			l.globalBytes.take(l.cfg.GlobalBytes, n)
+		}
+		l.lock.Unlock()
+	}
+	if allowed {
+		peer.frames.take(l.cfg.ConnFrames, 1)
+		peer.bytes.take(l.cfg.ConnBytes, n)
+		return false, nil
+	}
+	ThrottleEvents.WithLabelValues(l.cfg.Action.String()).Inc()
+	if l.cfg.Action == RateLimitClose {
+		return false, ErrRateLimited
+	}
+	return true, nil
+}
+
+// tokenBucket 速率和容量由调用方传入, rate <= 0 表示不限制
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) refill(rate float64, now time.Time) {
+	if b.last.IsZero() {
+		b.tokens = rate
+	} else {
+		b.tokens = min(rate, b.tokens+now.Sub(b.last).Seconds()*rate)
+	}
+	b.last = now
+}
+
+// reserve 无条件扣除 n 个令牌(允许透支), 返回令牌补足还需等待的时长
+func (b *tokenBucket) reserve(rate, n float64, now time.Time) time.Duration {
+	if rate <= 0 {
+		return 0
+	}
+	b.refill(rate, now)
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / rate * float64(time.Second))
+}
+
+// has 补充令牌后检查是否足够扣除 n 个, 不扣除. n 超过桶容量时只要求桶是满的
+func (b *tokenBucket) has(rate, n float64, now time.Time) bool {
+	if rate <= 0 {
+		return true
+	}
+	b.refill(rate, now)
+	return b.tokens >= min(n, rate)
+}
+
+// take 扣除 n 个令牌, 先用 has 检查
+func (b *tokenBucket) take(rate, n float64) {
+	if rate > 0 {
+		b.tokens -= n
+	}
+}
+
+// allow 令牌足够时扣除并返回 true, 用于只有一个桶的场景
+func (b *tokenBucket) allow(rate, n float64, now time.Time) bool {
+	if !b.has(rate, n, now) {
+		return false
+	}
+	b.take(rate, n)
+	return true
+}
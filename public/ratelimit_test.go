@@ -0,0 +1,142 @@
+package public
+
+import (
+	"testing"
+	"time"
+)
+
+// bucketTake 在 start+at 时尝试扣除 n 个令牌
+type bucketTake struct {
+	at time.Duration
+	n  float64
+}
+
+func TestTokenBucket(t *testing.T) {
+	start := time.Unix(1700000000, 0)
+	tests := []struct {
+		name  string
+		rate  float64
+		takes []bucketTake
+		want  []bool
+	}{
+		{
+			name:  "unlimited",
+			rate:  0,
+			takes: []bucketTake{{0, 1e9}, {0, 1e9}},
+			want:  []bool{true, true},
+		},
+		{
+			name:  "starts full",
+			rate:  3,
+			takes: []bucketTake{{0, 1}, {0, 1}, {0, 1}, {0, 1}},
+			want:  []bool{true, true, true, false},
+		},
+		{
+			name:  "refills at rate",
+			rate:  2,
+			takes: []bucketTake{{0, 2}, {0, 1}, {250 * time.Millisecond, 1}, {500 * time.Millisecond, 1}},
+			want:  []bool{true, false, false, true},
+		},
+		{
+			name:  "refill capped at capacity",
+			rate:  2,
+			takes: []bucketTake{{0, 2}, {time.Hour, 2}, {time.Hour, 1}},
+			want:  []bool{true, true, false},
+		},
+		{
+			name:  "oversized needs a full bucket",
+			rate:  100,
+			takes: []bucketTake{{0, 150}, {time.Second, 150}, {2500 * time.Millisecond, 150}},
+			want:  []bool{true, false, true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b tokenBucket
+			for i, take := range tt.takes {
+				if got := b.allow(tt.rate, take.n, start.Add(take.at)); got != tt.want[i] {
+					t.Fatalf("take %d: allow = %v, want %v", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestTokenBucketHasDoesNotTake(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	var b tokenBucket
+	for range 3 {
+		if !b.has(1, 1, now) {
+			t.Fatal("has = false on a full bucket")
+		}
+	}
+	b.take(1, 1)
+	if b.has(1, 1, now) {
+		t.Fatal("has = true after take emptied the bucket")
+	}
+}
+
+func TestTokenBucketReserve(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	var b tokenBucket
+	if wait := b.reserve(10, 10, now); wait != 0 {
+		t.Fatalf("first reserve wait = %v, want 0", wait)
+	}
+	if wait := b.reserve(10, 5, now); wait != 500*time.Millisecond {
+		t.Fatalf("overdrawn reserve wait = %v, want 500ms", wait)
+	}
+	if wait := b.reserve(10, 0, now.Add(500*time.Millisecond)); wait != 0 {
+		t.Fatalf("wait after repaying the debt = %v, want 0", wait)
+	}
+}
+
+func TestRateLimiterDropChargesOnlyWhenAllBucketsAllow(t *testing.T) {
+	for _, action := range []RateLimitAction{RateLimitDrop, RateLimitClose} {
+		t.Run(action.String(), func(t *testing.T) {
+			l := NewRateLimiter(RateLimitConfig{ConnFrames: 2, ConnBytes: 100, Action: action})
+			peer := &Peer{}
+			if drop, err := l.Limit(peer, 80); drop || err != nil {
+				t.Fatalf("first frame: drop = %v, err = %v", drop, err)
+			}
+			// 字节桶只剩 20, 帧桶不能因为这一帧被扣除
+			if drop, err := l.Limit(peer, 50); !drop && err == nil {
+				t.Fatal("frame over the byte budget was allowed")
+			}
+			if drop, err := l.Limit(peer, 10); drop || err != nil {
+				t.Fatalf("frame within both budgets: drop = %v, err = %v", drop, err)
+			}
+		})
+	}
+}
+
+func TestRateLimiterGlobalDenialKeepsConnTokens(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{ConnFrames: 1, GlobalBytes: 100, Action: RateLimitDrop})
+	a, b := &Peer{}, &Peer{}
+	if drop, _ := l.Limit(a, 100); drop {
+		t.Fatal("first frame dropped")
+	}
+	if drop, _ := l.Limit(b, 10); !drop {
+		t.Fatal("frame over the global byte budget was allowed")
+	}
+	if b.frames.tokens != 1 {
+		t.Fatalf("conn frame tokens after global denial = %v, want 1", b.frames.tokens)
+	}
+	// 全局桶恢复后, b 仍然可以发送它的第一帧
+	l.globalBytes.tokens = 100
+	if drop, _ := l.Limit(b, 10); drop {
+		t.Fatal("frame dropped after the global bucket refilled")
+	}
+}
+
+func TestRateLimiterDelay(t *testing.T) {
+	l := NewRateLimiter(RateLimitConfig{ConnFrames: 1, Action: RateLimitDelay})
+	peer := &Peer{}
+	for i := range 2 {
+		if drop, err := l.Limit(peer, 1); drop || err != nil {
+			t.Fatalf("frame %d: drop = %v, err = %v", i, drop, err)
+		}
+	}
+	if wait := time.Until(peer.ResumeAt); wait <= 0 || wait > time.Second {
+		t.Fatalf("ResumeAt in %v, want within (0, 1s]", wait)
+	}
+}
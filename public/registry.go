@@ -0,0 +1,220 @@
+package public
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Registry 记录 backend 当前持有的连接及其 Peer, 供心跳, 内存保护等在事件循环之外遍历连接.
+// C 为各 backend 的连接类型(*Conn / gnet.Conn).
+// 连接存放在连续的 entries 中, index 记录每个连接的位置, 删除时用最后一个连接填补空位,
+// 这样可以按位置分段遍历, 见 scan 与 Slice. ids 按 Peer.ID 索引连接, 供管理接口查找, 见 Lookup
+type Registry[C comparable] struct {
+	lock    sync.RWMutex
+	index   map[C]int
+	ids     map[uint64]C
+	entries []topEntry[C]
+}
+
+// registryChunk scan 每次持有读锁遍历的连接数
+const registryChunk = 4096
+
+func NewRegistry[C comparable]() *Registry[C] {
+	return &Registry[C]{index: make(map[C]int), ids: make(map[uint64]C)}
+}
+
+func (r *Registry[C]) Add(conn C, peer *Peer) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if i, ok := r.index[conn]; ok {
+		r.removeID(conn, r.entries[i].peer)
+		r.entries[i].peer = peer
+		r.ids[peer.ID] = conn
+		return
+	}
+	r.index[conn] = len(r.entries)
+	r.ids[peer.ID] = conn
+	r.entries = append(r.entries, topEntry[C]{conn, peer})
+}
+
+func (r *Registry[C]) Remove(conn C) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	i, ok := r.index[conn]
+	if !ok {
+		return
+	}
+	r.removeID(conn, r.entries[i].peer)
+	last := len(r.entries) - 1
+	if i != last {
+		r.entries[i] = r.entries[last]
+		r.index[r.entries[i].conn] = i
+	}
+	r.entries[last] = topEntry[C]{}
+	r.entries = r.entries[:last]
+	delete(r.index, conn)
+}
+
+// removeID 删除 peer 的 ID 索引, ID 已经指向别的连接时保留. 需要持有写锁
+func (r *Registry[C]) removeID(conn C, peer *Peer) {
+	if c, ok := r.ids[peer.ID]; ok && c == conn {
+		delete(r.ids, peer.ID)
+	}
+}
+
+// Lookup 按 Peer.ID 查找连接, 不存在时返回 false
+func (r *Registry[C]) Lookup(id uint64) (conn C, peer *Peer, ok bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if conn, ok = r.ids[id]; ok {
+		peer = r.entries[r.index[conn]].peer
+	}
+	return conn, peer, ok
+}
+
+// Peer 返回 conn 的 Peer, 已经移除时返回 nil
+func (r *Registry[C]) Peer(conn C) *Peer {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if i, ok := r.index[conn]; ok {
+		return r.entries[i].peer
+	}
+	return nil
+}
+
+func (r *Registry[C]) Len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.entries)
+}
+
+// Range 持有读锁遍历, fn 返回 false 时停止. fn 中不能调用 Add/Remove
+func (r *Registry[C]) Range(fn func(conn C, peer *Peer) bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	for _, e := range r.entries {
+		if !fn(e.conn, e.peer) {
+			return
+		}
+	}
+}
+
+// scan 分段遍历, 每段持有一次读锁, 段之间 Add/Remove 可以进行.
+// 遍历期间被删除的连接的位置由最后一个连接填补, 因此个别连接可能被跳过或者访问两次
+func (r *Registry[C]) scan(fn func(conn C, peer *Peer)) {
+	for start := 0; ; start += registryChunk {
+		r.lock.RLock()
+		if start >= len(r.entries) {
+			r.lock.RUnlock()
+			return
+		}
+		for _, e := range r.entries[start:min(start+registryChunk, len(r.entries))] {
+			fn(e.conn, e.peer)
+		}
+		r.lock.RUnlock()
+	}
+}
+
+// Slice 返回从位置 start 开始(对连接数取模, 到末尾后回到开头)的最多 n 个连接的副本, 以及下一段的起始位置.
+// 依次用返回的位置调用可以轮流取到所有连接, 不需要遍历全部连接
+func (r *Registry[C]) Slice(start, n int) ([]C, int) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	total := len(r.entries)
+	if total == 0 || n <= 0 {
+		return nil, 0
+	}
+	n = min(n, total)
+	conns := make([]C, 0, n)
+	i := start % total
+	for range n {
+		conns = append(conns, r.entries[i].conn)
+		if i++; i == total {
+			i = 0
+		}
+	}
+	return conns, i
+}
+
+// ConnSummary /connections 返回的连接概况
+type ConnSummary struct {
+	Connections int `json:"connections"`
+	// Tenants 按 "租户/ALPN 协议" 计数, 非 tls backend 为空
+	Tenants map[string]int `json:"tenants,omitempty"`
+	// OldestSeconds 最早建立的连接已存在的时长
+	OldestSeconds float64 `json:"oldest_seconds"`
+	// MaxIdleSeconds 最久没有收到帧的连接空闲的时长
+	MaxIdleSeconds float64 `json:"max_idle_seconds"`
+}
+
+// Summary 遍历所有连接生成概况
+func (r *Registry[C]) Summary(now time.Time) ConnSummary {
+	var s ConnSummary
+	r.Range(func(conn C, peer *Peer) bool {
+		s.Connections++
+		s.OldestSeconds = max(s.OldestSeconds, now.Sub(peer.ConnectedAt).Seconds())
+		s.MaxIdleSeconds = max(s.MaxIdleSeconds, peer.Idle(now).Seconds())
+		if peer.Tenant != "" {
+			if s.Tenants == nil {
+				s.Tenants = make(map[string]int)
+			}
+			labels := peer.tenantLabels()
+			s.Tenants[labels[0]+"/"+labels[1]]++
+		}
+		return true
+	})
+	return s
+}
+
+// Top 返回按 less 排序最靠前的 n 个连接, less(a, b) 为 true 表示 a 排在 b 前面.
+// 遍历期间增删的连接可能被漏掉, 返回的连接也可能已经被移除
+func (r *Registry[C]) Top(n int, less func(a, b *Peer) bool) []C {
+	if n <= 0 {
+		return nil
+	}
+	// 大小为 n 的堆, 堆顶是已选中的连接里排序最靠后的那个.
+	// 分段遍历, 不在整个遍历期间阻塞 Add/Remove; 同一个连接可能访问两次, 用 selected 去重
+	h := &topHeap[C]{less: less}
+	selected := make(map[C]struct{}, n)
+	r.scan(func(conn C, peer *Peer) {
+		if _, ok := selected[conn]; ok {
+			return
+		}
+		if h.Len() < n {
+			heap.Push(h, topEntry[C]{conn, peer})
+		} else if less(peer, h.entries[0].peer) {
+			delete(selected, h.entries[0].conn)
+			h.entries[0] = topEntry[C]{conn, peer}
+			heap.Fix(h, 0)
+		} else {
+			return
+		}
+		selected[conn] = struct{}{}
+	})
+	conns := make([]C, h.Len())
+	for i := len(conns) - 1; i >= 0; i-- {
+		conns[i] = heap.Pop(h).(topEntry[C]).conn
+	}
+	return conns
+}
+
+type topEntry[C comparable] struct {
+	conn C
+	peer *Peer
+}
+
+type topHeap[C comparable] struct {
+	entries []topEntry[C]
+	less    func(a, b *Peer) bool
+}
+
+func (h *topHeap[C]) Len() int           { return len(h.entries) }
+func (h *topHeap[C]) Less(i, j int) bool { return h.less(h.entries[j].peer, h.entries[i].peer) }
+func (h *topHeap[C]) Swap(i, j int)      { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+func (h *topHeap[C]) Push(x any)         { h.entries = append(h.entries, x.(topEntry[C])) }
+func (h *topHeap[C]) Pop() any {
+	last := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return last
+}
@@ -0,0 +1,103 @@
+package public
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// SessionTicketKeys 管理 tls 会话票据密钥: 最新的密钥用于签发票据, 之前的 keep-1 个密钥只用于解密,
+// 因此轮换后旧票据在 (keep-1)*interval 内仍然可以恢复会话.
+// 密钥只在进程内存中, handoff 后新进程使用新的密钥, 客户端会退化为完整握手
+type SessionTicketKeys struct {
+	config *tls.Config
+	keep   int
+	keys   [][32]byte
+}
+
+// NewSessionTicketKeys 生成第一个密钥并设置到 config 上, keep 至少为 1
+func NewSessionTicketKeys(config *tls.Config, keep int) (*SessionTicketKeys, error) {
+	k := &SessionTicketKeys{config: config, keep: max(keep, 1)}
+	if err := k.Rotate(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Rotate 生成新的签发密钥, 超出 keep 的最旧密钥被丢弃
+func (k *SessionTicketKeys) Rotate() error {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return fmt.Errorf("generate session ticket key failed: %w", err)
+	}
+	k.keys = append([][32]byte{key}, k.keys[:min(len(k.keys), k.keep-1)]...)
+	// SetSessionTicketKeys 可以在握手进行中并发调用
+	k.config.SetSessionTicketKeys(k.keys)
+	Logger.Debug("session ticket keys rotated", zap.Int("keys", len(k.keys)))
+	return nil
+}
+
+// Run 每 interval 轮换一次密钥, 直到 ctx 结束
+func (k *SessionTicketKeys) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := k.Rotate(); err != nil {
+				Logger.Error("rotate session ticket keys failed", zap.Error(err))
+			}
+		}
+	}
+}
+
+// ObserveHandshake 按租户和完整握手/会话恢复分别记录服务端握手耗时
+func ObserveHandshake(d time.Duration, state tls.ConnectionState, tenant string) {
+	mode := "full"
+	if state.DidResume {
+		mode = "resumed"
+	}
+	HandshakeDuration.WithLabelValues(tenant, mode).Observe(d.Seconds())
+}
+
+// ObserveHandshakeError 记录失败的握手: 超时计入 HandshakeTimeouts, 其他按告警类型计入 HandshakeFailures
+func ObserveHandshakeError(err error) {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		HandshakeTimeouts.Inc()
+		return
+	}
+	HandshakeFailures.WithLabelValues(handshakeAlert(err)).Inc()
+}
+
+// handshakeAlert 将握手错误归类为有限的几种标签值. 对端发来的告警取告警名(如 remote_bad_certificate),
+// 本端发出的告警 crypto/tls 没有暴露类型, 只区分证书校验失败与其他
+func handshakeAlert(err error) string {
+	var recordErr tls.RecordHeaderError
+	var verifyErr *tls.CertificateVerificationError
+	var opErr *net.OpError
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	case errors.As(err, &recordErr):
+		return "not_tls"
+	case errors.As(err, &verifyErr):
+		return "bad_certificate"
+	case errors.As(err, &opErr) && opErr.Op == "remote error":
+		return "remote_" + strings.ReplaceAll(strings.TrimPrefix(opErr.Err.Error(), "tls: "), " ", "_")
+	}
+	return "local"
+}
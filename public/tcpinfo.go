@@ -0,0 +1,109 @@
+package public
+
+import (
+	"context"
+	"syscall"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// TCPInfoSampler 定时读取一部分连接 socket 的 TCP_INFO, 把 rtt, cwnd, 重传等内核统计导出为直方图,
+// 用来区分延迟升高是应用处理慢还是网络问题(重传, 拥塞窗口缩小, 发送队列积压).
+// C 为各 backend 的连接类型(*Conn / gnet.Conn), 都可以通过 Fd 取到 socket, 实现了 syscall.Conn 的 *Conn 通过 RawConn 读取, 见 observeConn
+type TCPInfoSampler[C interface {
+	comparable
+	Fd() int
+}] struct {
+	registry *Registry[C]
+	interval time.Duration
+	batch    int
+	// next 下一轮从 registry 中的这个位置开始取连接
+	next int
+}
+
+// NewTCPInfoSampler 每个 interval 采样 registry 中 batch 个连接, 连接按在 registry 中的位置轮流被采样,
+// 连接数为 n 时每个连接约每 n/batch 个 interval 采样一次
+func NewTCPInfoSampler[C interface {
+	comparable
+	Fd() int
+}](registry *Registry[C], interval time.Duration, batch int) *TCPInfoSampler[C] {
+	return &TCPInfoSampler[C]{registry: registry, interval: interval, batch: batch}
+}
+
+// Run 阻塞执行采样, 直到 ctx 结束. interval 或 batch 不大于 0 时直接返回
+func (s *TCPInfoSampler[C]) Run(ctx context.Context) {
+	if s.interval <= 0 || s.batch <= 0 {
+		return
+	}
+	Logger.Info("tcp info sampler started", zap.Duration("interval", s.interval), zap.Int("batch", s.batch))
+
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		sampled, failed := s.sample()
+		Logger.Debug("tcp info sampled", zap.Int("sampled", sampled), zap.Int("failed", failed))
+	}
+}
+
+// sample 从上一轮结束的位置取 batch 个连接, 只在取连接时持有 registry 的读锁, 系统调用在锁外进行.
+// 期间已经关闭的连接读取失败, 计入 TCPInfoErrors
+func (s *TCPInfoSampler[C]) sample() (sampled, failed int) {
+	var conns []C
+	conns, s.next = s.registry.Slice(s.next, s.batch)
+	for _, conn := range conns {
+		if err := observeConn(conn); err != nil {
+			TCPInfoErrors.Inc()
+			failed++
+			continue
+		}
+		sampled++
+	}
+	return sampled, failed
+}
+
+// observeConn 读取连接的 TCP_INFO. 实现了 syscall.Conn 的连接在 RawConn.Control 中读取, 期间持有 fd 的引用,
+// 不会与关闭竞争, 也不会读到复用了同一个 fd 的新连接. gnet.Conn 只能通过 Fd 读取,
+// fd 在事件循环中关闭之后读取失败, 被新连接复用时读到的是新连接, 只影响一个样本
+func observeConn[C interface{ Fd() int }](conn C) error {
+	sc, ok := any(conn).(syscall.Conn)
+	if !ok {
+		return observeTCPInfo(conn.Fd())
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var observeErr error
+	if err := rc.Control(func(fd uintptr) { observeErr = observeTCPInfo(int(fd)) }); err != nil {
+		return err
+	}
+	return observeErr
+}
+
+// observeTCPInfo 读取一个 socket 的 TCP_INFO 和发送队列长度并记录到直方图
+func observeTCPInfo(fd int) error {
+	info, err := unix.GetsockoptTCPInfo(fd, unix.IPPROTO_TCP, unix.TCP_INFO)
+	if err != nil {
+		return err
+	}
+	// SIOCOUTQ 为已写入但对端还没有确认的字节数, 包括已发送未确认和还没有发送的部分
+	queued, err := unix.IoctlGetInt(fd, unix.SIOCOUTQ)
+	if err != nil {
+		return err
+	}
+	// rtt 单位为微秒
+	TCPRTT.Observe(float64(info.Rtt) / 1e6)
+	TCPRTTVar.Observe(float64(info.Rttvar) / 1e6)
+	TCPRetransmits.Observe(float64(info.Total_retrans))
+	TCPCwnd.Observe(float64(info.Snd_cwnd))
+	TCPUnacked.Observe(float64(info.Unacked))
+	TCPSendQueue.Observe(float64(queued))
+	return nil
+}
@@ -0,0 +1,22 @@
+package public
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+// TestObserveConnClosed 通过 RawConn 读取 TCP_INFO, 连接关闭之后返回 net.ErrClosed 而不是读取一个可能已被复用的 fd
+func TestObserveConnClosed(t *testing.T) {
+	server, _ := tcpPair(t)
+	conn := NewConn(server)
+	if err := observeConn(conn); err != nil {
+		t.Fatalf("observe open conn: %v", err)
+	}
+	_ = conn.Close()
+	// 关闭后立即建立新连接, 通常会复用同一个 fd
+	tcpPair(t)
+	if err := observeConn(conn); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("observe closed conn = %v, want %v", err, net.ErrClosed)
+	}
+}
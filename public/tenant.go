@@ -0,0 +1,106 @@
+package public
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// DefaultTenant 没有 SNI 或 SNI 不在证书目录中的连接所属的租户, 使用 -cert 指定的默认证书
+const DefaultTenant = "default"
+
+// Handler 处理一个数据帧的 body, 返回回复帧的 body, nil 表示不回复.
+// 心跳帧由 HandleHeartbeat 处理, 不会交给 Handler
+type Handler interface {
+	Handle(peer *Peer, body []byte) ([]byte, error)
+}
+
+// HandlerFunc 把函数适配为 Handler
+type HandlerFunc func(peer *Peer, body []byte) ([]byte, error)
+
+func (f HandlerFunc) Handle(peer *Peer, body []byte) ([]byte, error) {
+	return f(peer, body)
+}
+
+// Router 按 ALPN 协议名选择 Handler. 没有协商 ALPN 的连接使用 fallback
+type Router struct {
+	handlers map[string]Handler
+	protos   []string
+	fallback Handler
+}
+
+// NewRouter fallback 用于没有协商 ALPN 的连接
+func NewRouter(fallback Handler) *Router {
+	return &Router{handlers: make(map[string]Handler), fallback: fallback}
+}
+
+// Handle 注册 ALPN 协议名 proto 的 Handler, 只能在服务启动前调用
+func (r *Router) Handle(proto string, h Handler) {
+	if _, ok := r.handlers[proto]; !ok {
+		r.protos = append(r.protos, proto)
+	}
+	r.handlers[proto] = h
+}
+
+// Protocols 按注册顺序返回协议名, 作为 tls.Config.NextProtos. 客户端提供多个时 crypto/tls 按服务端的顺序选择,
+// 客户端提供了 ALPN 但都不在其中时握手失败(no_application_protocol)
+func (r *Router) Protocols() []string {
+	return r.protos
+}
+
+// Handler 返回协议 proto 的 Handler
+func (r *Router) Handler(proto string) Handler {
+	if h, ok := r.handlers[proto]; ok {
+		return h
+	}
+	return r.fallback
+}
+
+// Serve 把数据帧的 body 交给连接协议对应的 Handler, 按租户和协议计数
+func (r *Router) Serve(peer *Peer, body []byte) ([]byte, error) {
+	TenantRequests.WithLabelValues(peer.tenantLabels()...).Inc()
+	return r.Handler(peer.Protocol).Handle(peer, body)
+}
+
+// TenantConnected 握手完成, 连接的租户和协议确定之后调用, 与 TenantDisconnected 成对
+func TenantConnected(peer *Peer) {
+	TenantConnections.WithLabelValues(peer.tenantLabels()...).Inc()
+}
+
+func TenantDisconnected(peer *Peer) {
+	TenantConnections.WithLabelValues(peer.tenantLabels()...).Dec()
+}
+
+func (p *Peer) tenantLabels() []string {
+	proto := p.Protocol
+	if proto == "" {
+		proto = "none"
+	}
+	return []string{p.Tenant, proto}
+}
+
+// EchoHandler 原样返回 body, 并按其中的发送时间记录延迟
+var EchoHandler = HandlerFunc(func(peer *Peer, body []byte) ([]byte, error) {
+	observeMsgLatency(body)
+	return body, nil
+})
+
+// AckHandler 只回复 body 中的 id 和 ts, 不回传其他字段, 用于客户端发送较大消息时减少下行流量
+var AckHandler = HandlerFunc(func(peer *Peer, body []byte) ([]byte, error) {
+	msg, ok := observeMsgLatency(body)
+	if !ok {
+		return nil, nil
+	}
+	reply, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("marshal ack failed: %w", err)
+	}
+	return reply, nil
+})
+
+// NewDefaultRouter tls backend 共用的路由: ALPN "echo" 回显, "ack" 只回 id/ts, 不协商 ALPN 时回显
+func NewDefaultRouter() *Router {
+	r := NewRouter(EchoHandler)
+	r.Handle("echo", EchoHandler)
+	r.Handle("ack", AckHandler)
+	return r
+}
@@ -0,0 +1,270 @@
+package public
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/metrics"
+	"runtime/pprof"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+)
+
+const (
+	watchdogCheckInterval = 5 * time.Second
+	// watchdogCPUDuration 每个快照中 CPU profile 的采样时长
+	watchdogCPUDuration = 10 * time.Second
+	// watchdogMutexFraction 开启 watchdog 后 mutex profile 的采样率, 平均每 100 次锁竞争记录一次
+	watchdogMutexFraction = 100
+	snapshotPrefix        = "snapshot-"
+)
+
+// WatchdogConfig 触发快照的阈值, 为 0 的阈值不检测
+type WatchdogConfig struct {
+	// Dir 快照目录, 为空时不启动 watchdog
+	Dir        string
+	RSS        uint64
+	Goroutines int
+	// GCPause 检测周期内最长的一次 GC 停顿
+	GCPause time.Duration
+	// P99Latency 检测周期内 latency_seconds 的 p99, 取所在桶的上界
+	P99Latency time.Duration
+	// Cooldown 两次快照的最小间隔
+	Cooldown time.Duration
+	// Keep 保留的快照个数, 超出时删除最早的
+	Keep int
+}
+
+// Watchdog 定期检查 RSS, goroutine 数, GC 停顿和延迟, 超过阈值时把 CPU, heap, goroutine, mutex profile 保存到目录中,
+// 便于事后分析压测中途出现的问题
+type Watchdog struct {
+	cfg         WatchdogConfig
+	samples     []metrics.Sample
+	prevPauses  []uint64
+	prevLatency []uint64
+	lastCapture time.Time
+}
+
+func NewWatchdog(cfg WatchdogConfig) *Watchdog {
+	return &Watchdog{
+		cfg: cfg,
+		samples: []metrics.Sample{
+			{Name: "/sched/goroutines:goroutines"},
+			{Name: "/sched/pauses/total/gc:seconds"},
+		},
+	}
+}
+
+// Run 阻塞执行检测, 直到 ctx 结束. 没有设置目录或阈值时直接返回
+func (w *Watchdog) Run(ctx context.Context) {
+	cfg := w.cfg
+	if cfg.Dir == "" || (cfg.RSS == 0 && cfg.Goroutines == 0 && cfg.GCPause == 0 && cfg.P99Latency == 0) {
+		return
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		Logger.Error("create profile dir failed", zap.Error(err))
+		return
+	}
+	runtime.SetMutexProfileFraction(watchdogMutexFraction)
+	Logger.Info("watchdog started", zap.String("dir", cfg.Dir), zap.Uint64("rss", cfg.RSS), zap.Int("goroutines", cfg.Goroutines),
+		zap.Duration("gcPause", cfg.GCPause), zap.Duration("p99", cfg.P99Latency), zap.Duration("cooldown", cfg.Cooldown))
+
+	// 第一次检测只记录基线
+	w.check()
+	ticker := time.NewTicker(watchdogCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		reasons, values := w.check()
+		if len(reasons) == 0 || time.Since(w.lastCapture) < cfg.Cooldown {
+			continue
+		}
+		w.lastCapture = time.Now()
+		Logger.Warn("watchdog triggered", zap.Strings("reasons", reasons), zap.Strings("values", values))
+		for _, reason := range reasons {
+			ProfileSnapshots.WithLabelValues(reason).Inc()
+		}
+		if err := w.capture(reasons, values); err != nil {
+			Logger.Error("capture profiles failed", zap.Error(err))
+		}
+		w.prune()
+	}
+}
+
+// check 返回超过阈值的项, 以及所有检测值("name=value", 用于日志和快照中的 trigger.txt)
+func (w *Watchdog) check() (reasons, values []string) {
+	cfg := w.cfg
+	metrics.Read(w.samples)
+	if cfg.RSS > 0 {
+		if rss, err := readRSS(); err != nil {
+			Logger.Debug("read rss failed", zap.Error(err))
+		} else {
+			values = append(values, fmt.Sprintf("rss=%d", rss))
+			if rss >= cfg.RSS {
+				reasons = append(reasons, "rss")
+			}
+		}
+	}
+	if cfg.Goroutines > 0 {
+		n := w.samples[0].Value.Uint64()
+		values = append(values, fmt.Sprintf("goroutines=%d", n))
+		if n >= uint64(cfg.Goroutines) {
+			reasons = append(reasons, "goroutines")
+		}
+	}
+	if cfg.GCPause > 0 {
+		pause := w.maxGCPause(w.samples[1].Value.Float64Histogram())
+		values = append(values, fmt.Sprintf("gc_pause=%s", pause))
+		if pause >= cfg.GCPause {
+			reasons = append(reasons, "gc_pause")
+		}
+	}
+	if cfg.P99Latency > 0 {
+		if p99, ok := w.latencyP99(); ok {
+			values = append(values, fmt.Sprintf("p99_latency=%s", p99))
+			if p99 >= cfg.P99Latency {
+				reasons = append(reasons, "p99_latency")
+			}
+		}
+	}
+	return reasons, values
+}
+
+// maxGCPause 上次检测以来最长的 GC 停顿, 取所在桶的下界
+func (w *Watchdog) maxGCPause(h *metrics.Float64Histogram) time.Duration {
+	prev := w.prevPauses
+	w.prevPauses = slices.Clone(h.Counts)
+	if len(prev) != len(h.Counts) {
+		return 0
+	}
+	for i := len(h.Counts) - 1; i >= 0; i-- {
+		if h.Counts[i] > prev[i] {
+			return time.Duration(max(h.Buckets[i], 0) * float64(time.Second))
+		}
+	}
+	return 0
+}
+
+// latencyP99 上次检测以来 Latency 的 p99, 取所在经典桶的上界; 落在 +Inf 桶时取最大的有限上界. 期间没有样本时返回 false
+func (w *Watchdog) latencyP99() (time.Duration, bool) {
+	var m dto.Metric
+	if err := Latency.Write(&m); err != nil {
+		return 0, false
+	}
+	h := m.GetHistogram()
+	cum := make([]uint64, len(h.GetBucket())+1)
+	for i, b := range h.GetBucket() {
+		cum[i] = b.GetCumulativeCount()
+	}
+	cum[len(cum)-1] = h.GetSampleCount()
+	prev := w.prevLatency
+	w.prevLatency = cum
+	if len(prev) != len(cum) || cum[len(cum)-1] == prev[len(prev)-1] {
+		return 0, false
+	}
+
+	total := cum[len(cum)-1] - prev[len(prev)-1]
+	rank := uint64(math.Ceil(0.99 * float64(total)))
+	bounds := h.GetBucket()
+	for i := range bounds {
+		if cum[i]-prev[i] >= rank {
+			return time.Duration(bounds[i].GetUpperBound() * float64(time.Second)), true
+		}
+	}
+	return time.Duration(bounds[len(bounds)-1].GetUpperBound() * float64(time.Second)), true
+}
+
+// capture 在新的快照目录中写入各 profile, CPU profile 需要采样 watchdogCPUDuration
+func (w *Watchdog) capture(reasons, values []string) error {
+	name := snapshotPrefix + time.Now().UTC().Format("20060102T150405Z") + "-" + strings.Join(reasons, "+")
+	dir := filepath.Join(w.cfg.Dir, name)
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return err
+	}
+
+	trigger := "reasons=" + strings.Join(reasons, ",") + "\n" + strings.Join(values, "\n") + "\n"
+	if err := os.WriteFile(filepath.Join(dir, "trigger.txt"), []byte(trigger), 0o644); err != nil {
+		return err
+	}
+
+	for _, profile := range []string{"heap", "goroutine", "mutex"} {
+		if err := writeProfile(dir, profile); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Create(filepath.Join(dir, "cpu.pprof"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// 正在通过 /debug/pprof/profile 采样时无法同时采样
+	if err := pprof.StartCPUProfile(f); err != nil {
+		return fmt.Errorf("start cpu profile failed: %w", err)
+	}
+	time.Sleep(watchdogCPUDuration)
+	pprof.StopCPUProfile()
+	Logger.Info("profiles captured", zap.String("dir", dir))
+	return nil
+}
+
+func writeProfile(dir, name string) error {
+	f, err := os.Create(filepath.Join(dir, name+".pprof"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pprof.Lookup(name).WriteTo(f, 0)
+}
+
+// prune 只保留最新的 Keep 个快照. 目录名以 UTC 时间开头, 按名字排序即按时间排序
+func (w *Watchdog) prune() {
+	entries, err := os.ReadDir(w.cfg.Dir)
+	if err != nil {
+		Logger.Error("read profile dir failed", zap.Error(err))
+		return
+	}
+	var snapshots []string
+	for _, e := range entries {
+		if e.IsDir() && strings.HasPrefix(e.Name(), snapshotPrefix) {
+			snapshots = append(snapshots, e.Name())
+		}
+	}
+	slices.Sort(snapshots)
+	for len(snapshots) > max(w.cfg.Keep, 1) {
+		if err := os.RemoveAll(filepath.Join(w.cfg.Dir, snapshots[0])); err != nil {
+			Logger.Error("remove snapshot failed", zap.Error(err))
+		}
+		snapshots = snapshots[1:]
+	}
+}
+
+// readRSS 从 /proc/self/statm 读取常驻内存
+func readRSS() (uint64, error) {
+	data, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, fmt.Errorf("illegal statm: %q", data)
+	}
+	pages, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return pages * uint64(os.Getpagesize()), nil
+}
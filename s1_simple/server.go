@@ -1,84 +1,189 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"net"
+	"os"
+	"os/signal"
 	"server_millionclient/public"
 	"server_millionclient/public/protocol"
+	"syscall"
 	"time"
 
 	"go.uber.org/zap"
 )
 
 var (
-	addr    = flag.String("addr", ":8000", "server addr")
-	verbose = flag.Bool("verbose", false, "verbose")
+	commonFlags  = public.NewCommonFlags()
+	handoff      = flag.String("handoff", "", "unix socket path for zero-downtime restart, empty to disable")
+	handoffDrain = flag.Duration("handoff-drain", 30*time.Second, "after handing off, wait up to this long for connections left in this process to close")
+	proxyTimeout = flag.Duration("proxy-timeout", 10*time.Second, "deadline of reading the PROXY header with -proxy-protocol, 0 for none")
+)
+
+var (
+	limiter   *public.RateLimiter
+	admission *public.Admission
 )
 
 func main() {
 	flag.Parse()
-	public.InitLogger(*verbose)
-	public.SetLimit()
+	// 收到 SIGINT/SIGTERM 时停止 accept, drain 后正常返回, 以便 defer 关闭管理服务并导出剩余的 span 和指标
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	common, shutdown := commonFlags.Setup(ctx, "s1_simple")
+	defer shutdown()
+
+	limiter, admission = common.Limiter, common.Admission
+	registry := public.NewRegistry[*public.Conn]()
 
-	public.Logger.Info("listening", zap.String("addr", *addr))
-	ln, err := net.Listen("tcp", *addr)
+	// 阻塞读的 goroutine 无法在帧边界上暂停, 这里只交接 listener
+	inh, err := public.Inherit(*handoff)
 	if err != nil {
-		public.Logger.Fatal("listen error", zap.Error(err))
+		public.Logger.Fatal("inherit failed", zap.Error(err))
+	}
+	var ln net.Listener
+	if len(inh.Listeners) > 0 {
+		ln = inh.Listeners[0]
+	} else {
+		public.Logger.Info("listening", zap.String("addr", commonFlags.Addr))
+		if ln, err = net.Listen("tcp", commonFlags.Addr); err != nil {
+			public.Logger.Fatal("listen error", zap.Error(err))
+		}
 	}
 
-	go public.ServeMetrics()
+	admin := public.StartAdmin(common, registry, func(conn *public.Conn) { _ = conn.Shutdown() }, inh.Admin)
+	defer admin.Shutdown()
 
+	public.RunMonitors(common, registry,
+		func(conn *public.Conn, ping []byte) error {
+			_, err := conn.Write(ping)
+			return err
+		},
+		func(conn *public.Conn, size int) { _ = conn.SetBuffers(size) },
+		func(conn *public.Conn) { _ = conn.Shutdown() })
+	if *handoff != "" {
+		go func() {
+			if err := public.ServeHandoff(*handoff, func() *public.Inheritance {
+				return &public.Inheritance{Listeners: []net.Listener{ln}, Admin: admin.Listener()}
+			}, nil); err != nil {
+				public.Logger.Error("serve handoff failed", zap.Error(err))
+			}
+		}()
+	}
+
+	// 关闭 listener 后 accept 循环按交接之后的方式 drain 并返回
+	defer context.AfterFunc(ctx, func() {
+		public.Logger.Info("received signal, shutting down")
+		admin.SetReady(false)
+		_ = ln.Close()
+	})()
+
+	admin.SetReady(true)
 	for {
-		conn, err := ln.Accept()
+		conn, err := admission.Accept(ln)
 		if err != nil {
 			public.Logger.Error("tcp accept failed", zap.Error(err))
 
 			if errors.Is(err.(*net.OpError).Err, net.ErrClosed) {
+				public.Drain(registry, *handoffDrain)
 				return
 			}
 			continue
 		}
 
 		go func() {
+			conn, ok := acceptConn(conn)
+			if !ok {
+				return
+			}
 			public.ConnectionCount.Inc()
+			registry.Add(conn, conn.Peer)
 			for {
 				if err := handleConn(conn); err != nil {
 					if !errors.Is(err, io.EOF) {
-						public.Logger.Info("handle conn failed", zap.Error(err))
+						public.Logger.Info("handle conn failed", zap.Stringer("remote", conn.RemoteAddr()), zap.Error(err))
 					}
 					public.ConnectionCount.Dec()
+					public.ObserveClose(conn.Peer, err)
+					admission.Release()
+					registry.Remove(conn)
 					_ = conn.Close()
 					break
 				}
+				if wait := time.Until(conn.ResumeAt); wait > 0 {
+					time.Sleep(wait)
+				}
 			}
 		}()
 	}
 }
 
-func handleConn(conn net.Conn) error {
+// acceptConn 开启 PROXY protocol 时先读取 PROXY 头, 失败时关闭连接并返回 false
+func acceptConn(rawConn net.Conn) (*public.Conn, bool) {
+	if !commonFlags.ProxyProtocol {
+		return public.NewConn(rawConn), true
+	}
+	feed, header, err := public.ReadProxyHeader(rawConn, *proxyTimeout)
+	if err != nil {
+		public.Logger.Info("read proxy header failed", zap.Stringer("remote", rawConn.RemoteAddr()), zap.Error(err))
+		public.RejectedConnections.WithLabelValues(public.RejectProxyHeader).Inc()
+		admission.Release()
+		_ = rawConn.Close()
+		return nil, false
+	}
+	conn := public.NewConn(feed)
+	conn.ClientAddr = header.ClientAddr(rawConn.RemoteAddr())
+	return conn, true
+}
+
+func handleConn(conn *public.Conn) error {
 	defer public.RequestCount.Inc()
-	_, body, err := protocol.Read(conn)
+	header, body, err := protocol.Read(conn)
 	if err != nil {
 		return fmt.Errorf("read failed: %w", err)
 	}
-	_ = body
-	public.Logger.Debug("read", zap.ByteString("body", body))
+	// 阻塞读取时 Read 包含等待下一帧的时间, 从读完之后开始计时
+	start := time.Now()
+	conn.Seen()
+	conn.FrameIn(protocol.HeaderSize + len(body))
+	if drop, err := limiter.Limit(conn.Peer, protocol.HeaderSize+len(body)); err != nil || drop {
+		return err
+	}
+	ft, body, err := public.StartFrameTrace(header, body, start)
+	if err != nil {
+		return fmt.Errorf("read trace context failed: %w", err)
+	}
+	defer ft.End()
+	if reply, ok, err := public.HandleHeartbeat(header, body); ok {
+		if err != nil {
+			return fmt.Errorf("heartbeat failed: %w", err)
+		}
+		if reply != nil {
+			if err := conn.WriteFrame(conn, reply); err != nil {
+				return fmt.Errorf("write pong failed: %w", err)
+			}
+		}
+		return nil
+	}
+	public.Logger.Debug("read", zap.Stringer("remote", conn.RemoteAddr()), zap.ByteString("body", body))
 	var msg public.Msg
 	if err = json.Unmarshal(body, &msg); err != nil {
 		public.Logger.Info("unmarshal failed", zap.Error(err))
 	} else {
-		public.Latency.Observe(float64(time.Now().UnixMilli() - msg.Ts))
+		public.ObserveLatency(msg.Ts, time.Now())
 	}
 
 	// echo
+	ft.Stage("write")
 	if bytes, err := protocol.Pack(body); err != nil {
 		return fmt.Errorf("pack failed: %w", err)
 	} else {
-		if _, err := conn.Write(bytes); err != nil {
+		if err := conn.WriteFrame(conn, bytes); err != nil {
 			return fmt.Errorf("write failed: %w", err)
 		}
 	}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"cmp"
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"net"
-	_ "net/http/pprof"
+	"os"
+	"os/signal"
 	"runtime"
 	"server_millionclient/public"
 	"server_millionclient/public/protocol"
@@ -17,52 +20,166 @@ import (
 )
 
 var (
-	addr    = flag.String("addr", ":8000", "server addr")
-	verbose = flag.Bool("verbose", false, "verbose")
+	commonFlags  = public.NewCommonFlags()
+	handoff      = flag.String("handoff", "", "unix socket path for zero-downtime restart, empty to disable")
+	handoffConns = flag.Bool("handoff-conns", true, "also hand off established connections on restart")
+	handoffDrain = flag.Duration("handoff-drain", 30*time.Second, "after handing off, wait up to this long for connections left in this process to close")
 )
 
-var epoller *public.Epoll
+var (
+	epoller   *public.Epoll
+	registry  *public.Registry[*public.Conn]
+	limiter   *public.RateLimiter
+	admission *public.Admission
+)
 
 func main() {
 	flag.Parse()
-	public.InitLogger(*verbose)
-	public.SetLimit()
+	// 收到 SIGINT/SIGTERM 时停止 accept, drain 后正常返回, 以便 defer 关闭管理服务并导出剩余的 span 和指标
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	common, shutdown := commonFlags.Setup(ctx, "s2_epoll")
+	defer shutdown()
 
-	public.Logger.Info("listening", zap.String("addr", *addr))
-	ln, err := net.Listen("tcp", *addr)
+	limiter, admission = common.Limiter, common.Admission
+	registry = public.NewRegistry[*public.Conn]()
+	// 驱逐时只关闭读端, 由事件循环读到 EOF 后统一清理
+	public.RunMonitors(common, registry,
+		func(conn *public.Conn, ping []byte) error {
+			_, err := conn.Write(ping)
+			return err
+		},
+		func(conn *public.Conn, size int) { _ = conn.SetBuffers(size) },
+		func(conn *public.Conn) { _ = conn.Shutdown() })
+
+	inh, err := public.Inherit(*handoff)
 	if err != nil {
-		public.Logger.Fatal("listen error", zap.Error(err))
+		public.Logger.Fatal("inherit failed", zap.Error(err))
+	}
+	var ln net.Listener
+	if len(inh.Listeners) > 0 {
+		ln = inh.Listeners[0]
+	} else {
+		public.Logger.Info("listening", zap.String("addr", commonFlags.Addr))
+		if ln, err = net.Listen("tcp", commonFlags.Addr); err != nil {
+			public.Logger.Fatal("listen error", zap.Error(err))
+		}
 	}
 
-	go public.ServeMetrics()
+	admin := public.StartAdmin(common, registry, func(conn *public.Conn) { _ = conn.Shutdown() }, inh.Admin)
+	defer admin.Shutdown()
 
 	// Start epoll
 	epoller, err = public.MkEpoll()
 	if err != nil {
 		public.Logger.Fatal("mk epoll failed", zap.Error(err))
 	}
+	epoller.Instrument("0")
+	for _, conn := range inh.Conns {
+		admission.Track()
+		adoptConn(conn)
+	}
 	go Start()
 
+	if *handoff != "" {
+		go func() {
+			if err := public.ServeHandoff(*handoff, func() *public.Inheritance {
+				exported := &public.Inheritance{Listeners: []net.Listener{ln}, Admin: admin.Listener()}
+				if *handoffConns {
+					exported.Conns = epoller.Detach()
+					forgetConns(exported.Conns)
+				}
+				return exported
+			}, func(exported *public.Inheritance) {
+				// 新进程没有接管, 连接回到当前进程的事件循环
+				for _, conn := range exported.Conns {
+					adoptConn(conn)
+				}
+			}); err != nil {
+				public.Logger.Error("serve handoff failed", zap.Error(err))
+			}
+		}()
+	}
+
+	// 关闭 listener 后 accept 循环按交接之后的方式 drain 并返回
+	defer context.AfterFunc(ctx, func() {
+		public.Logger.Info("received signal, shutting down")
+		admin.SetReady(false)
+		_ = ln.Close()
+	})()
+
+	admin.SetReady(true)
 	for {
-		conn, err := ln.Accept()
+		conn, err := admission.Accept(ln)
 		if err != nil {
 			public.Logger.Error("tcp accept failed", zap.Error(err))
 
 			if errors.Is(err.(*net.OpError).Err, net.ErrClosed) {
+				public.Drain(registry, *handoffDrain)
 				return
 			}
 			continue
 		}
 
-		if err := epoller.Add(conn); err != nil {
+		if commonFlags.ProxyProtocol {
+			// PROXY 头由事件循环非阻塞地读取, 读完后换成 public.Conn
+			if err := epoller.Add(public.NewFeedConn(conn)); err != nil {
+				public.Logger.Error("epoller add connection failed", zap.Error(err))
+				admission.Release()
+				_ = conn.Close()
+			}
+			continue
+		}
+		addConn(public.NewConn(conn))
+	}
+}
+
+// adoptConn 加入从旧进程交接来的连接. 旧进程已经读出的数据在连接的缓冲区中, 不会再有可读事件, 通过 Ready 交给事件循环
+func adoptConn(conn net.Conn) {
+	switch c := conn.(type) {
+	case *public.FeedConn:
+		// PROXY 头还没有读完
+		if err := epoller.Add(c); err != nil {
 			public.Logger.Error("epoller add connection failed", zap.Error(err))
-			_ = conn.Close()
-		} else {
-			public.ConnectionCount.Inc()
+			admission.Release()
+			_ = c.Close()
+			return
+		}
+	case *public.Conn:
+		if !addConn(c) {
+			return
+		}
+	}
+	if public.HasBuffered(conn) {
+		if err := epoller.Ready(conn); err != nil {
+			public.Logger.Error("epoller ready connection failed", zap.Error(err))
+		}
+	}
+}
+
+// forgetConns 交给新进程的连接不再由当前进程处理, 从 registry 移除, 不计入交接后的 drain
+func forgetConns(conns []net.Conn) {
+	for _, conn := range conns {
+		if c, ok := conn.(*public.Conn); ok {
+			public.ConnectionCount.Dec()
+			registry.Remove(c)
 		}
 	}
 }
 
+func addConn(conn *public.Conn) bool {
+	if err := epoller.Add(conn); err != nil {
+		public.Logger.Error("epoller add connection failed", zap.Error(err))
+		admission.Release()
+		_ = conn.Close()
+		return false
+	}
+	public.ConnectionCount.Inc()
+	conn.Loop = epoller.Stats()
+	registry.Add(conn, conn.Peer)
+	return true
+}
+
 func Start() {
 	for {
 		connections, err := epoller.Wait()
@@ -79,37 +196,108 @@ func Start() {
 			if conn == nil {
 				break
 			}
-			if err := handleConn(conn); err != nil {
-				public.ConnectionCount.Dec()
-				if err := epoller.Remove(conn); err != nil {
-					public.Logger.Error("epoller remove connection failed", zap.Error(err))
-				}
-				_ = conn.Close()
+			switch c := conn.(type) {
+			case *public.FeedConn:
+				acceptProxy(c)
+			case *public.Conn:
+				serveConn(c)
 			}
 		}
 	}
 }
 
-func handleConn(conn net.Conn) error {
+// serveConn 处理一个帧, 返回 false 表示连接已关闭或者被限速暂停
+func serveConn(c *public.Conn) bool {
+	if err := handleConn(c); err != nil {
+		public.ConnectionCount.Dec()
+		public.ObserveClose(c.Peer, err)
+		admission.Release()
+		registry.Remove(c)
+		if err := epoller.Remove(c); err != nil {
+			public.Logger.Error("epoller remove connection failed", zap.Error(err))
+		}
+		_ = c.Close()
+		return false
+	}
+	if wait := time.Until(c.ResumeAt); wait > 0 {
+		if err := epoller.Pause(c, wait); err != nil {
+			public.Logger.Error("epoller pause connection failed", zap.Error(err))
+		}
+		return false
+	}
+	return true
+}
+
+// acceptProxy 在事件循环中读取 PROXY 头, 读完后换成 public.Conn 重新加入 epoll.
+// 头之后已经读入缓冲区的数据 socket 上不会再有可读事件, 立即处理
+func acceptProxy(feed *public.FeedConn) {
+	_, fillErr := feed.Fill()
+	header, err := feed.ReadProxyHeader()
+	if header == nil && err == nil && fillErr == nil {
+		return
+	}
+	if err := epoller.Remove(feed); err != nil {
+		public.Logger.Error("epoller remove connection failed", zap.Error(err))
+	}
+	if header == nil {
+		public.Logger.Info("read proxy header failed", zap.Stringer("remote", feed.RemoteAddr()), zap.Error(cmp.Or(err, fillErr)))
+		public.RejectedConnections.WithLabelValues(public.RejectProxyHeader).Inc()
+		admission.Release()
+		_ = feed.Close()
+		return
+	}
+	feed.Direct()
+	conn := public.NewConn(feed)
+	conn.ClientAddr = header.ClientAddr(feed.RemoteAddr())
+	if !addConn(conn) {
+		return
+	}
+	for feed.Buffered() > 0 && serveConn(conn) {
+	}
+}
+
+func handleConn(conn *public.Conn) error {
 	defer public.RequestCount.Inc()
-	_, body, err := protocol.Read(conn)
+	start := time.Now()
+	header, body, err := protocol.Read(conn)
 	if err != nil {
 		return fmt.Errorf("read failed: %w", err)
 	}
-	_ = body
-	public.Logger.Debug("read", zap.ByteString("body", body))
+	conn.Seen()
+	conn.FrameIn(protocol.HeaderSize + len(body))
+	if drop, err := limiter.Limit(conn.Peer, protocol.HeaderSize+len(body)); err != nil || drop {
+		return err
+	}
+	ft, body, err := public.StartFrameTrace(header, body, start)
+	if err != nil {
+		return fmt.Errorf("read trace context failed: %w", err)
+	}
+	defer ft.End()
+	if reply, ok, err := public.HandleHeartbeat(header, body); ok {
+		if err != nil {
+			return fmt.Errorf("heartbeat failed: %w", err)
+		}
+		if reply != nil {
+			if err := conn.WriteFrame(conn, reply); err != nil {
+				return fmt.Errorf("write pong failed: %w", err)
+			}
+		}
+		return nil
+	}
+	public.Logger.Debug("read", zap.Stringer("remote", conn.RemoteAddr()), zap.ByteString("body", body))
 	var msg public.Msg
 	if err = json.Unmarshal(body, &msg); err != nil {
 		public.Logger.Info("unmarshal failed", zap.Error(err))
 	} else {
-		public.Latency.Observe(float64(time.Now().UnixMilli() - msg.Ts))
+		public.ObserveLatency(msg.Ts, time.Now())
 	}
 
 	// echo
+	ft.Stage("write")
 	if bytes, err := protocol.Pack(body); err != nil {
 		return fmt.Errorf("pack failed: %w", err)
 	} else {
-		if _, err := conn.Write(bytes); err != nil {
+		if err := conn.WriteFrame(conn, bytes); err != nil {
 			return fmt.Errorf("write failed: %w", err)
 		}
 	}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
+	"os"
+	"os/signal"
 	"server_millionclient/public"
 	"server_millionclient/public/protocol"
+	"syscall"
 	"time"
 
 	"github.com/panjf2000/gnet/v2"
@@ -13,52 +17,185 @@ import (
 )
 
 var (
-	addr    = flag.String("addr", ":8000", "server addr")
-	verbose = flag.Bool("verbose", false, "verbose")
+	commonFlags = public.NewCommonFlags()
 )
 
 func main() {
 	flag.Parse()
-	public.InitLogger(*verbose)
-	public.SetLimit()
+	// 收到 SIGINT/SIGTERM 时停止 engine, gnet.Run 正常返回, 以便 defer 关闭管理服务并导出剩余的 span 和指标
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	common, shutdown := commonFlags.Setup(ctx, "s4_gnet_singlecore")
+	defer shutdown()
 
-	go public.ServeMetrics()
+	limiter, admission := common.Limiter, common.Admission
+	registry := public.NewRegistry[gnet.Conn]()
+	public.RunMonitors(common, registry,
+		func(conn gnet.Conn, ping []byte) error { return conn.AsyncWrite(ping, nil) },
+		func(conn gnet.Conn, size int) {
+			_ = conn.SetReadBuffer(size)
+			_ = conn.SetWriteBuffer(size)
+		},
+		func(conn gnet.Conn) { _ = conn.Close() })
 
-	public.Logger.Info("listening", zap.String("addr", *addr))
+	admin := public.StartAdmin(common, registry, func(conn gnet.Conn) { _ = conn.Close() }, nil)
+	defer admin.Shutdown()
+
+	public.Logger.Info("listening", zap.String("addr", commonFlags.Addr))
 	p := goroutine.Default()
 	defer p.Release()
-	eventHandler := &server{pool: p}
-	addrFull := *addr
+	eventHandler := &server{ctx: ctx, pool: p, admin: admin, registry: registry, limiter: limiter, admission: admission}
+	addrFull := commonFlags.Addr
 	if addrFull[0] == ':' {
-		addrFull = "0.0.0.0" + *addr
+		addrFull = "0.0.0.0" + commonFlags.Addr
 	}
 	if err := gnet.Run(eventHandler, "tcp://"+addrFull, gnet.WithMulticore(false), gnet.WithLogger(public.Logger.Sugar())); err != nil {
 		public.Logger.Fatal("gnet.Run failed", zap.Error(err))
 	}
 }
 
-func (s *server) OnOpen(_ gnet.Conn) (out []byte, action gnet.Action) {
+// OnBoot 所有 event loop 都已经开始监听, 之后 /readyz 才返回 200
+func (s *server) OnBoot(eng gnet.Engine) (action gnet.Action) {
+	s.eng = eng
+	s.admin.SetReady(true)
+	// 收到信号时停止 engine, 关闭所有连接
+	context.AfterFunc(s.ctx, func() {
+		public.Logger.Info("received signal, shutting down")
+		s.admin.SetReady(false)
+		if err := eng.Stop(context.Background()); err != nil {
+			public.Logger.Error("stop engine failed", zap.Error(err))
+		}
+	})
+	return
+}
+
+func (s *server) OnOpen(conn gnet.Conn) (out []byte, action gnet.Action) {
+	// gnet 自己 accept, fd 耗尽的处理由 gnet 负责, 这里只做连接数和速率检查.
+	// 被拒绝的连接不设置 context, OnClose 据此跳过清理
+	if reason := s.admission.Admit(); reason != "" {
+		return nil, gnet.Close
+	}
 	public.ConnectionCount.Inc()
+	peer := public.NewPeer()
+	// 开启 PROXY protocol 时 ClientAddr 在 OnTraffic 读到 PROXY 头之后设置
+	if !commonFlags.ProxyProtocol {
+		peer.ClientAddr = conn.RemoteAddr()
+	}
+	peer.Loop = public.LoopStats(conn)
+	peer.Loop.AddFds(1)
+	conn.SetContext(peer)
+	s.registry.Add(conn, peer)
 	return
 }
 
 func (s *server) OnTraffic(conn gnet.Conn) (action gnet.Action) {
+	peer := conn.Context().(*public.Peer)
+	defer func(start time.Time) { peer.Loop.Traffic(time.Since(start)) }(time.Now())
+	peer.Seen()
+	if peer.ClientAddr == nil {
+		if action = readProxyHeader(conn, peer); action != gnet.None || peer.ClientAddr == nil {
+			return
+		}
+	}
+	// 一次可读事件中可能已经缓冲了多个帧(如 pong 与数据帧), 处理完所有完整的帧, 不完整的留到下次
+	for {
+		// 限速暂停期间到达的数据留在 inbound buffer 中, 等 Wake 后再处理
+		if time.Now().Before(peer.ResumeAt) {
+			return
+		}
+		headerRaw, err := conn.Peek(protocol.HeaderSize)
+		if err != nil {
+			return
+		}
+		frameLen, err := protocol.FrameLen(headerRaw)
+		if err != nil {
+			public.Logger.Info("read failed", zap.Error(err))
+			peer.MarkClose(public.CloseProtocol)
+			return gnet.Close
+		}
+		if conn.InboundBuffered() < frameLen {
+			return
+		}
+		peer.FrameIn(frameLen)
+		drop, err := s.limiter.Limit(peer, frameLen)
+		if err != nil {
+			peer.MarkClose(public.CloseRateLimit)
+			return gnet.Close
+		}
+		if drop {
+			_, _ = conn.Discard(frameLen)
+			continue
+		}
+		if action = s.handleFrame(conn); action != gnet.None {
+			return
+		}
+		if wait := time.Until(peer.ResumeAt); wait > 0 {
+			time.AfterFunc(wait, func() { _ = conn.Wake(nil) })
+			return
+		}
+	}
+}
+
+// readProxyHeader 在第一个帧之前从 inbound buffer 中解析 PROXY 头, 头不完整时留到下次 OnTraffic
+func readProxyHeader(conn gnet.Conn, peer *public.Peer) gnet.Action {
+	buf, _ := conn.Peek(-1)
+	header, n, err := public.ParseProxyHeader(buf)
+	if err != nil {
+		public.Logger.Info("read proxy header failed", zap.Stringer("remote", conn.RemoteAddr()), zap.Error(err))
+		public.RejectedConnections.WithLabelValues(public.RejectProxyHeader).Inc()
+		peer.MarkClose(public.CloseProtocol)
+		return gnet.Close
+	}
+	if header == nil {
+		return gnet.None
+	}
+	_, _ = conn.Discard(n)
+	peer.ClientAddr = header.ClientAddr(conn.RemoteAddr())
+	return gnet.None
+}
+
+func (s *server) handleFrame(conn gnet.Conn) (action gnet.Action) {
 	defer public.RequestCount.Inc()
-	_, body, err := protocol.Read(conn)
+	start := time.Now()
+	peer := conn.Context().(*public.Peer)
+	header, body, err := protocol.Read(conn)
 	if err != nil {
 		public.Logger.Info("read failed", zap.Error(err))
+		peer.MarkClose(public.ClassifyClose(err))
 		return gnet.Close
 	}
-	_ = body
-	public.Logger.Debug("read", zap.ByteString("body", body))
+	ft, body, err := public.StartFrameTrace(header, body, start)
+	if err != nil {
+		public.Logger.Info("read trace context failed", zap.Error(err))
+		peer.MarkClose(public.CloseProtocol)
+		return gnet.Close
+	}
+	defer ft.End()
+	if reply, ok, err := public.HandleHeartbeat(header, body); ok {
+		if err != nil {
+			public.Logger.Info("heartbeat failed", zap.Error(err))
+			return gnet.Close
+		}
+		if reply != nil {
+			if err := conn.AsyncWrite(reply, nil); err != nil {
+				public.Logger.Info("async write pong failed", zap.Error(err))
+				peer.MarkClose(public.CloseWriteError)
+				return gnet.Close
+			}
+			peer.FrameOut(len(reply))
+		}
+		return
+	}
+	public.Logger.Debug("read", zap.Stringer("remote", peer.ClientAddr), zap.ByteString("body", body))
 	var msg public.Msg
 	if err = json.Unmarshal(body, &msg); err != nil {
 		public.Logger.Info("unmarshal failed", zap.Error(err))
 	} else {
-		public.Latency.Observe(float64(time.Now().UnixMilli() - msg.Ts))
+		public.ObserveLatency(msg.Ts, time.Now())
 	}
 
 	// echo
+	ft.Stage("write")
 	if bytes, err := protocol.Pack(body); err != nil {
 		public.Logger.Info("pack failed", zap.Error(err))
 		return gnet.Close
@@ -70,22 +207,38 @@ func (s *server) OnTraffic(conn gnet.Conn) (action gnet.Action) {
 			return err
 		}); err != nil {
 			public.Logger.Info("async write failed", zap.Error(err))
+			peer.MarkClose(public.CloseWriteError)
 			return gnet.Close
 		}
+		peer.FrameOut(len(bytes))
 	}
 	return
 }
 
-func (s *server) OnClose(_ gnet.Conn, _ error) (action gnet.Action) {
+// OnClose err 为 gnet 读写 socket 的错误, 由 action 或 Close 关闭时为 nil, 此时原因来自 MarkClose
+func (s *server) OnClose(conn gnet.Conn, err error) (action gnet.Action) {
+	if conn.Context() == nil {
+		return
+	}
 	public.ConnectionCount.Dec()
+	peer := conn.Context().(*public.Peer)
+	public.ObserveClose(peer, err)
+	peer.Loop.AddFds(-1)
+	s.admission.Release()
+	s.registry.Remove(conn)
 	return
 }
 
 type server struct {
 	gnet.BuiltinEventEngine
 
-	pool *goroutine.Pool
-	eng  gnet.Engine
+	ctx       context.Context
+	pool      *goroutine.Pool
+	eng       gnet.Engine
+	admin     *public.Admin
+	registry  *public.Registry[gnet.Conn]
+	limiter   *public.RateLimiter
+	admission *public.Admission
 }
 
 var _ gnet.EventHandler = (*server)(nil)
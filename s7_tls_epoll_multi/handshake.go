@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"os"
+	"server_millionclient/public"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// handshakeIdleTimeout 超过 minWorkers 的 worker 空闲这么久后退出
+const handshakeIdleTimeout = 30 * time.Second
+
+// handshakeConn 握手中的连接, 握手由事件循环驱动:
+// 事件循环在可读事件时把 socket 上的数据喂给 feed, ClientHello 到齐之后才交给握手池,
+// worker 在 tls.Conn 上执行握手, 等待对端数据时阻塞在 feed 上而不是 socket 上.
+// 握手结束后通过 Epoll.Ready 交还事件循环, 由事件循环换成 public.Conn 或者清理.
+// 因此 ClientHello 到齐之前不占用 goroutine; 之后等待客户端的下一段记录(如 Finished)时让出 worker, 见 handshakePool.detach,
+// 慢速客户端只占用一个等待中的 goroutine, 不会占满握手池而阻塞新的握手
+type handshakeConn struct {
+	*tls.Conn
+	feed     *public.FeedConn
+	epoller  *public.Epoll
+	deadline time.Time
+	expire   *time.Timer
+	// secrets 开启 kTLS 时收集握手得到的流量密钥
+	secrets *public.KTLSSecrets
+
+	// dispatched 已交给握手池, 事件循环写, expire 定时器读
+	dispatched atomic.Bool
+	// done worker 写入 err/duration 后置位
+	done     atomic.Bool
+	err      error
+	duration time.Duration
+
+	// 以下只由事件循环访问
+	finished bool
+	eof      bool
+	// proxyPending 开启 PROXY protocol 且还没有读到 PROXY 头
+	proxyPending bool
+	// clientAddr 原始客户端地址, 见 public.Peer.ClientAddr
+	clientAddr net.Addr
+}
+
+func newHandshakeConn(conn net.Conn, config *tls.Config, epoller *public.Epoll, timeout time.Duration, ktls, proxyProtocol bool) *handshakeConn {
+	feed := public.NewFeedConn(conn)
+	hc := &handshakeConn{feed: feed, epoller: epoller, proxyPending: proxyProtocol, clientAddr: conn.RemoteAddr()}
+	if ktls {
+		// 密钥只能通过 KeyLogWriter 拿到, 每个连接一份配置
+		hc.secrets = &public.KTLSSecrets{}
+		config = config.Clone()
+		config.KeyLogWriter = hc.secrets
+	}
+	hc.Conn = tls.Server(feed, config)
+	if timeout > 0 {
+		hc.deadline = time.Now().Add(timeout)
+		_ = feed.SetDeadline(hc.deadline)
+		// ClientHello 迟迟不到齐时没有 worker 在等待, 关闭读端让事件循环读到 EOF 后清理
+		hc.expire = time.AfterFunc(timeout, func() {
+			if !hc.dispatched.Load() {
+				if tcpConn, ok := conn.(*net.TCPConn); ok {
+					_ = tcpConn.CloseRead()
+				}
+			}
+		})
+	}
+	return hc
+}
+
+// handleHandshake 在事件循环中处理握手中的连接: 可读时喂数据, worker 完成后收尾
+func handleHandshake(epoller *public.Epoll, pool *handshakePool, hc *handshakeConn) {
+	if hc.finished {
+		return
+	}
+	if hc.done.Load() {
+		finishHandshake(epoller, hc)
+		return
+	}
+	if hc.eof {
+		return
+	}
+	if _, err := hc.feed.Fill(); err != nil {
+		if !hc.dispatched.Load() {
+			abortHandshake(epoller, hc, err)
+			return
+		}
+		// worker 读完缓冲区后拿到 err, 握手失败并通过 Ready 交还事件循环.
+		// 对端关闭的 socket 会一直可读, 在那之前不再监听, 否则水平触发的事件循环会空转
+		hc.eof = true
+		hc.feed.Fail(err)
+		if err := epoller.Mute(hc); err != nil {
+			public.Logger.Error("epoller mute connection failed", zap.Error(err))
+		}
+		return
+	}
+	// PROXY 头在 tls 之外, ClientHello 之前先从缓冲区中取出
+	if hc.proxyPending {
+		header, err := hc.feed.ReadProxyHeader()
+		if err != nil {
+			public.Logger.Info("read proxy header failed", zap.Stringer("remote", hc.clientAddr), zap.Error(err))
+			public.RejectedConnections.WithLabelValues(public.RejectProxyHeader).Inc()
+			abortHandshake(epoller, hc, nil)
+			return
+		}
+		if header == nil {
+			return
+		}
+		hc.proxyPending = false
+		hc.clientAddr = header.ClientAddr(hc.clientAddr)
+	}
+	if !hc.dispatched.Load() && hc.feed.RecordReady() {
+		hc.dispatched.Store(true)
+		if !pool.Submit(hc) {
+			public.RejectedConnections.WithLabelValues(public.RejectHandshakeQueue).Inc()
+			abortHandshake(epoller, hc, nil)
+		}
+	}
+}
+
+func finishHandshake(epoller *public.Epoll, hc *handshakeConn) {
+	if hc.err != nil {
+		abortHandshake(epoller, hc, hc.err)
+		return
+	}
+	hc.finished = true
+	if hc.expire != nil {
+		hc.expire.Stop()
+	}
+	_ = hc.feed.SetDeadline(time.Time{})
+
+	state := hc.ConnectionState()
+	tenant := certs.Tenant(state.ServerName)
+	public.ObserveHandshake(hc.duration, state, tenant)
+	conn := public.NewConn(hc.Conn)
+	if hc.secrets != nil {
+		if conn = offloadKTLS(hc); conn == nil {
+			abortHandshake(epoller, hc, nil)
+			return
+		}
+	}
+	conn.Identity = public.TLSIdentity(state)
+	conn.Tenant, conn.Protocol = tenant, state.NegotiatedProtocol
+	conn.TLS = public.NewTLSInfo(state)
+	_, userTLS := conn.Conn.(*tls.Conn)
+	conn.TLS.KTLS = !userTLS
+	conn.ClientAddr = hc.clientAddr
+	public.Logger.Debug("connection established", zap.Stringer("remote", conn.RemoteAddr()), zap.String("identity", conn.Identity),
+		zap.String("tenant", conn.Tenant), zap.String("protocol", conn.Protocol))
+
+	if err := epoller.Remove(hc); err != nil {
+		public.Logger.Error("epoller remove connection failed", zap.Error(err))
+	}
+	if err := epoller.Add(conn); err != nil {
+		public.Logger.Error("epoller add connection failed", zap.Error(err))
+		admission.Release()
+		_ = hc.feed.Close()
+		return
+	}
+	hc.feed.Direct()
+	public.ConnectionCount.Inc()
+	public.TenantConnected(conn.Peer)
+	conn.Loop = epoller.Stats()
+	registry.Add(conn, conn.Peer)
+	// 握手期间事件循环可能已经把之后的数据读入了缓冲区, socket 上不会再有可读事件, 立即处理
+	if hc.feed.Buffered() > 0 {
+		serveConn(epoller, conn)
+	}
+}
+
+// offloadKTLS 尝试把加解密交给内核, 成功时返回基于原始 socket 的连接, 不支持时回退到用户态的 tls.Conn,
+// 只卸载了一半而无法继续使用时返回 nil
+func offloadKTLS(hc *handshakeConn) *public.Conn {
+	// 事件循环读入 feed 的数据内核看不到
+	if hc.feed.Buffered() > 0 {
+		public.KTLSOffload.WithLabelValues("fallback").Inc()
+		return public.NewConn(hc.Conn)
+	}
+	raw, err := public.EnableKTLS(hc.Conn, hc.secrets)
+	switch {
+	case err == nil:
+		public.KTLSOffload.WithLabelValues("offloaded").Inc()
+		return public.NewConn(raw)
+	case errors.Is(err, public.ErrKTLSUnsupported):
+		public.Logger.Debug("ktls fallback", zap.Stringer("remote", hc.clientAddr), zap.Error(err))
+		public.KTLSOffload.WithLabelValues("fallback").Inc()
+		return public.NewConn(hc.Conn)
+	}
+	public.Logger.Info("enable ktls failed", zap.Stringer("remote", hc.clientAddr), zap.Error(err))
+	public.KTLSOffload.WithLabelValues("failed").Inc()
+	return nil
+}
+
+// abortHandshake 清理握手失败或被拒绝的连接, err 为 nil 时不计入握手失败
+func abortHandshake(epoller *public.Epoll, hc *handshakeConn, err error) {
+	hc.finished = true
+	if hc.expire != nil {
+		hc.expire.Stop()
+	}
+	if err != nil {
+		if !hc.deadline.IsZero() && !time.Now().Before(hc.deadline) {
+			err = os.ErrDeadlineExceeded
+		}
+		public.ObserveHandshakeError(err)
+		public.Logger.Info("handshake failed", zap.Stringer("remote", hc.clientAddr), zap.Error(err))
+	}
+	admission.Release()
+	if err := epoller.Remove(hc); err != nil {
+		public.Logger.Error("epoller remove connection failed", zap.Error(err))
+	}
+	_ = hc.feed.Close()
+}
+
+// handshakePool tls 握手工作池: 常驻 minWorkers 个 worker, 队列有积压时逐个扩容到 maxWorkers,
+// 扩出来的 worker 空闲后退出. 队列有界, 满时 Submit 返回 false, 由调用方拒绝连接.
+// worker 只计算正在处理的握手, 等待客户端数据的握手脱离握手池, 数量受 -max-conns 与 -handshake-timeout 限制
+type handshakePool struct {
+	ctx        context.Context
+	queue      chan *handshakeConn
+	minWorkers int32
+	maxWorkers int32
+	workers    atomic.Int32
+}
+
+func newHandshakePool(ctx context.Context, minWorkers, maxWorkers, queueSize int) *handshakePool {
+	p := &handshakePool{
+		ctx:        ctx,
+		queue:      make(chan *handshakeConn, max(queueSize, 1)),
+		minWorkers: int32(max(minWorkers, 1)),
+		maxWorkers: int32(max(minWorkers, maxWorkers, 1)),
+	}
+	for range p.minWorkers {
+		p.workers.Add(1)
+		go p.worker()
+	}
+	public.HandshakeWorkers.Set(float64(p.workers.Load()))
+	return p
+}
+
+// Submit 把连接放入握手队列, 队列已满时返回 false
+func (p *handshakePool) Submit(hc *handshakeConn) bool {
+	select {
+	case p.queue <- hc:
+	default:
+		return false
+	}
+	public.HandshakeQueueDepth.Set(float64(len(p.queue)))
+	// 所有 worker 都在忙, 新连接在排队, 扩容一个 worker
+	if len(p.queue) > 0 {
+		p.grow()
+	}
+	return true
+}
+
+func (p *handshakePool) grow() {
+	for {
+		n := p.workers.Load()
+		if n >= p.maxWorkers {
+			return
+		}
+		if p.workers.CompareAndSwap(n, n+1) {
+			public.HandshakeWorkers.Set(float64(n + 1))
+			go p.worker()
+			return
+		}
+	}
+}
+
+// shrink 多于 minWorkers 时减少一个 worker, 返回 false 表示当前 worker 需要留下
+func (p *handshakePool) shrink() bool {
+	for {
+		n := p.workers.Load()
+		if n <= p.minWorkers {
+			return false
+		}
+		if p.workers.CompareAndSwap(n, n-1) {
+			public.HandshakeWorkers.Set(float64(n - 1))
+			return true
+		}
+	}
+}
+
+// detach 握手在等待客户端的下一段记录, 当前 goroutine 不再算作 worker: 让出名额,
+// 低于 minWorkers 或者有连接在排队时补充一个 worker. 握手结束后该 goroutine 直接退出
+func (p *handshakePool) detach() {
+	n := p.workers.Add(-1)
+	public.HandshakeWorkers.Set(float64(n))
+	public.HandshakeWaiting.Inc()
+	if n < p.minWorkers || len(p.queue) > 0 {
+		p.grow()
+	}
+}
+
+func (p *handshakePool) worker() {
+	idle := time.NewTimer(handshakeIdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		case hc := <-p.queue:
+			public.HandshakeQueueDepth.Set(float64(len(p.queue)))
+			if p.process(hc) {
+				return
+			}
+			idle.Reset(handshakeIdleTimeout)
+		case <-idle.C:
+			if p.shrink() {
+				return
+			}
+			idle.Reset(handshakeIdleTimeout)
+		}
+	}
+}
+
+// process 执行一次握手, 返回 true 表示期间已经 detach, 当前 goroutine 需要退出
+func (p *handshakePool) process(hc *handshakeConn) (detached bool) {
+	public.HandshakeInFlight.Inc()
+	defer public.HandshakeInFlight.Dec()
+
+	// 回调在 Handshake 的 goroutine 中执行, 不需要同步
+	hc.feed.OnWait(func() {
+		if !detached {
+			detached = true
+			p.detach()
+		}
+	})
+	start := time.Now()
+	hc.err = hc.Handshake()
+	hc.duration = time.Since(start)
+	hc.feed.OnWait(nil)
+	if detached {
+		public.HandshakeWaiting.Dec()
+	}
+	hc.done.Store(true)
+	if err := hc.epoller.Ready(hc); err != nil {
+		public.Logger.Error("epoller ready failed", zap.Error(err))
+	}
+	return detached
+}
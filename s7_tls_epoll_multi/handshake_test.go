@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"testing"
+	"time"
+
+	"server_millionclient/public"
+)
+
+// stallConn 第一次 Write(ClientHello)之后的写阻塞到 release, 模拟发完 ClientHello 就不再继续的慢速客户端
+type stallConn struct {
+	net.Conn
+	release chan struct{}
+	writes  int
+}
+
+func (c *stallConn) Write(b []byte) (int, error) {
+	if c.writes++; c.writes > 1 {
+		<-c.release
+	}
+	return c.Conn.Write(b)
+}
+
+// startHandshake 建立一个连接, 客户端在后台握手, 服务端的 handshakeConn 由测试代替事件循环喂数据, ClientHello 到齐后交给 pool
+func startHandshake(t *testing.T, ln net.Listener, server, client *tls.Config, epoller *public.Epoll, pool *handshakePool, wrap func(net.Conn) net.Conn) *handshakeConn {
+	t.Helper()
+	raw, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accept: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = raw.Close()
+		_ = conn.Close()
+	})
+	go func() { _ = tls.Client(wrap(raw), client).Handshake() }()
+
+	hc := newHandshakeConn(conn, server, epoller, 0, false, false)
+	go func() {
+		for {
+			n, err := hc.feed.Fill()
+			if err != nil {
+				hc.feed.Fail(err)
+				return
+			}
+			if n == 0 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+	}()
+	for deadline := time.Now().Add(5 * time.Second); !hc.feed.RecordReady(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("ClientHello not received")
+		}
+	}
+	hc.dispatched.Store(true)
+	if !pool.Submit(hc) {
+		t.Fatal("handshake queue full")
+	}
+	return hc
+}
+
+// TestHandshakePoolSlowClient 只有一个 worker 时, 发完 ClientHello 就停住的客户端不会阻塞之后的握手
+func TestHandshakePoolSlowClient(t *testing.T) {
+	ca, err := public.GenerateCA(time.Hour)
+	if err != nil {
+		t.Fatalf("generate ca: %v", err)
+	}
+	pair, err := public.GenerateServerCert(ca, []string{"127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatalf("generate server cert: %v", err)
+	}
+	cert, err := pair.TLSCertificate()
+	if err != nil {
+		t.Fatalf("load server cert: %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Cert)
+	server := &tls.Config{Certificates: []tls.Certificate{cert}}
+	client := &tls.Config{RootCAs: roots, ServerName: "127.0.0.1"}
+
+	epoller, err := public.MkEpoll()
+	if err != nil {
+		t.Fatalf("epoll: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pool := newHandshakePool(ctx, 1, 1, 16)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	release := make(chan struct{})
+	defer close(release)
+	slow := startHandshake(t, ln, server, client, epoller, pool, func(c net.Conn) net.Conn {
+		return &stallConn{Conn: c, release: release}
+	})
+	fast := startHandshake(t, ln, server, client, epoller, pool, func(c net.Conn) net.Conn { return c })
+	for deadline := time.Now().Add(5 * time.Second); !fast.done.Load(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("handshake blocked behind a slow client")
+		}
+	}
+	if fast.err != nil {
+		t.Fatalf("handshake: %v", fast.err)
+	}
+	if slow.done.Load() {
+		t.Fatal("slow client finished the handshake without sending Finished")
+	}
+	if n := pool.workers.Load(); n != 1 {
+		t.Fatalf("workers = %d, want 1", n)
+	}
+}
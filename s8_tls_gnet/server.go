@@ -0,0 +1,437 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"server_millionclient/public"
+	"server_millionclient/public/protocol"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+	"github.com/panjf2000/gnet/v2/pkg/pool/goroutine"
+	"go.uber.org/zap"
+)
+
+var (
+	commonFlags    = public.NewCommonFlags()
+	multicore      = flag.Bool("multicore", true, "run an event loop per cpu")
+	certFile       = flag.String("cert", "certs/server.pem", "server certificate file, see gencert")
+	keyFile        = flag.String("key", "certs/server-key.pem", "server private key file")
+	certDir        = flag.String("cert-dir", "", "directory of per-hostname <host>.pem + <host>-key.pem certificates selected by SNI, the host is the tenant, empty to disable")
+	clientAuth     = flag.String("client-auth", "none", "client certificate policy: none, request, require, verify-if-given or require-verify")
+	clientCA       = flag.String("client-ca", "certs/ca.pem", "ca certificate file to verify client certificates")
+	sessionTickets = flag.Bool("session-tickets", true, "issue tls session tickets so that clients can resume sessions")
+	ticketRotate   = flag.Duration("ticket-rotate", time.Hour, "interval to rotate the session ticket key")
+	ticketKeys     = flag.Int("ticket-keys", 3, "number of recent session ticket keys accepted for resumption")
+	hsTimeout      = flag.Duration("handshake-timeout", 10*time.Second, "deadline of a tls handshake, 0 for none")
+	certReload     = flag.Duration("cert-reload-interval", 10*time.Second, "interval to check the certificate file for changes, 0 to reload on SIGHUP only")
+)
+
+// nonBlocking 作为 FeedConn 的读期限, 缓冲区读空时立即返回超时, 握手之后 tls 记录层据此由事件循环驱动
+var nonBlocking = time.Unix(1, 0)
+
+func main() {
+	flag.Parse()
+	// 收到 SIGINT/SIGTERM 时停止 engine, gnet.Run 正常返回, 以便 defer 关闭管理服务并导出剩余的 span 和指标
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	common, shutdown := commonFlags.Setup(ctx, "s8_tls_gnet")
+	defer shutdown()
+
+	certs, err := public.NewCertReloader(*certFile, *keyFile, *certDir)
+	if err != nil {
+		public.Logger.Fatal("load certificate file failed", zap.Error(err))
+	}
+	go certs.Watch(context.Background(), *certReload)
+	router := public.NewDefaultRouter()
+	// ALPN 选择 Handler, 不提供 ALPN 的客户端使用回显
+	config := &tls.Config{GetCertificate: certs.GetCertificate, NextProtos: router.Protocols()}
+	if config.ClientAuth, err = public.ParseClientAuth(*clientAuth); err != nil {
+		public.Logger.Fatal("parse client auth failed", zap.Error(err))
+	}
+	if config.ClientAuth >= tls.VerifyClientCertIfGiven {
+		if config.ClientCAs, err = public.LoadCertPool(*clientCA); err != nil {
+			public.Logger.Fatal("load client ca failed", zap.Error(err))
+		}
+	}
+	if *sessionTickets {
+		keys, err := public.NewSessionTicketKeys(config, *ticketKeys)
+		if err != nil {
+			public.Logger.Fatal("init session ticket keys failed", zap.Error(err))
+		}
+		go keys.Run(context.Background(), *ticketRotate)
+	} else {
+		config.SessionTicketsDisabled = true
+	}
+
+	limiter, admission := common.Limiter, common.Admission
+	registry := public.NewRegistry[gnet.Conn]()
+	// registry 中只有握手完成的连接, ping 需要经过 tls 加密
+	public.RunMonitors(common, registry,
+		func(conn gnet.Conn, ping []byte) error {
+			_, err := conn.Context().(*session).tls.Write(ping)
+			return err
+		},
+		func(conn gnet.Conn, size int) {
+			_ = conn.SetReadBuffer(size)
+			_ = conn.SetWriteBuffer(size)
+		},
+		func(conn gnet.Conn) { _ = conn.Close() })
+
+	admin := public.StartAdmin(common, registry, func(conn gnet.Conn) { _ = conn.Close() }, nil)
+	defer admin.Shutdown()
+
+	public.Logger.Info("listening", zap.String("addr", commonFlags.Addr))
+	p := goroutine.Default()
+	defer p.Release()
+	eventHandler := &server{ctx: ctx, pool: p, admin: admin, config: config, certs: certs, router: router, registry: registry, limiter: limiter, admission: admission}
+	addrFull := commonFlags.Addr
+	if addrFull[0] == ':' {
+		addrFull = "0.0.0.0" + commonFlags.Addr
+	}
+	if err := gnet.Run(eventHandler, "tcp://"+addrFull, gnet.WithMulticore(*multicore), gnet.WithLogger(public.Logger.Sugar())); err != nil {
+		public.Logger.Fatal("gnet.Run failed", zap.Error(err))
+	}
+}
+
+// asyncConn 把 gnet.Conn 适配为 FeedConn 的底层连接: 握手在 pool 的 goroutine 中进行,
+// 只能通过 AsyncWrite 写. 读由 FeedConn 的缓冲区提供, deadline 也由 FeedConn 处理
+type asyncConn struct {
+	gnet.Conn
+}
+
+func (c asyncConn) Write(b []byte) (int, error) {
+	// tls.Conn 会复用 b
+	if err := c.AsyncWrite(bytes.Clone(b), nil); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (asyncConn) SetDeadline(time.Time) error      { return nil }
+func (asyncConn) SetReadDeadline(time.Time) error  { return nil }
+func (asyncConn) SetWriteDeadline(time.Time) error { return nil }
+
+// session gnet 连接上的 tls 状态, 作为连接的 context.
+// OnTraffic 把 inbound buffer 中的密文喂给 feed, ClientHello 到齐后握手交给 pool 执行,
+// 完成后 Wake 回到事件循环; 之后 tls 记录层在事件循环中非阻塞地解密, 明文帧在 plain 中拼接
+type session struct {
+	*public.Peer
+	tls      *tls.Conn
+	feed     *public.FeedConn
+	deadline time.Time
+	expire   *time.Timer
+
+	// dispatched 已交给 pool 握手, expired 超时被 expire 关闭
+	dispatched atomic.Bool
+	expired    atomic.Bool
+	// done worker 写入 err/duration 后置位
+	done     atomic.Bool
+	err      error
+	duration time.Duration
+
+	// 以下只由事件循环访问
+	established bool
+	failed      bool
+	plain       []byte
+	// proxyPending 开启 PROXY protocol 且还没有读到 PROXY 头
+	proxyPending bool
+}
+
+// OnBoot 所有 event loop 都已经开始监听, 之后 /readyz 才返回 200
+func (s *server) OnBoot(eng gnet.Engine) (action gnet.Action) {
+	s.admin.SetReady(true)
+	// 收到信号时停止 engine, 关闭所有连接
+	context.AfterFunc(s.ctx, func() {
+		public.Logger.Info("received signal, shutting down")
+		s.admin.SetReady(false)
+		if err := eng.Stop(context.Background()); err != nil {
+			public.Logger.Error("stop engine failed", zap.Error(err))
+		}
+	})
+	return
+}
+
+func (s *server) OnOpen(conn gnet.Conn) (out []byte, action gnet.Action) {
+	// gnet 自己 accept, fd 耗尽的处理由 gnet 负责, 这里只做连接数和速率检查.
+	// 被拒绝的连接不设置 context, OnClose 据此跳过清理
+	if reason := s.admission.Admit(); reason != "" {
+		return nil, gnet.Close
+	}
+	feed := public.NewFeedConn(asyncConn{conn})
+	sess := &session{Peer: public.NewPeer(), tls: tls.Server(feed, s.config), feed: feed, proxyPending: commonFlags.ProxyProtocol}
+	sess.ClientAddr = conn.RemoteAddr()
+	sess.Loop = public.LoopStats(conn)
+	sess.Loop.AddFds(1)
+	if *hsTimeout > 0 {
+		sess.deadline = time.Now().Add(*hsTimeout)
+		_ = feed.SetReadDeadline(sess.deadline)
+		// ClientHello 迟迟不到齐时没有 worker 在等待, 直接关闭; 已在握手的由 feed 的期限结束
+		sess.expire = time.AfterFunc(*hsTimeout, func() {
+			if !sess.dispatched.Load() {
+				sess.expired.Store(true)
+				_ = conn.Close()
+			}
+		})
+	}
+	conn.SetContext(sess)
+	return
+}
+
+func (s *server) OnTraffic(conn gnet.Conn) (action gnet.Action) {
+	sess := conn.Context().(*session)
+	defer func(start time.Time) { sess.Loop.Traffic(time.Since(start)) }(time.Now())
+	if conn.InboundBuffered() > 0 {
+		data, _ := conn.Next(-1)
+		sess.feed.Feed(data)
+		sess.Seen()
+	}
+	if !sess.established {
+		if sess.done.Load() {
+			return s.establish(conn, sess)
+		}
+		// PROXY 头在 tls 之外, ClientHello 之前先从缓冲区中取出
+		if sess.proxyPending {
+			header, err := sess.feed.ReadProxyHeader()
+			if err != nil {
+				public.Logger.Info("read proxy header failed", zap.Stringer("remote", sess.ClientAddr), zap.Error(err))
+				public.RejectedConnections.WithLabelValues(public.RejectProxyHeader).Inc()
+				sess.failed = true
+				return gnet.Close
+			}
+			if header == nil {
+				return
+			}
+			sess.proxyPending = false
+			sess.ClientAddr = header.ClientAddr(sess.ClientAddr)
+		}
+		if !sess.dispatched.Load() && sess.feed.RecordReady() {
+			sess.dispatched.Store(true)
+			if err := s.pool.Submit(func() { s.handshake(conn, sess) }); err != nil {
+				public.Logger.Info("submit handshake failed", zap.Error(err))
+				public.RejectedConnections.WithLabelValues(public.RejectHandshakeQueue).Inc()
+				sess.failed = true
+				return gnet.Close
+			}
+		}
+		return
+	}
+	return s.serve(conn, sess)
+}
+
+// handshake 在 pool 中执行, 等待对端数据时阻塞在 feed 上, 结束后唤醒事件循环
+func (s *server) handshake(conn gnet.Conn, sess *session) {
+	public.HandshakeInFlight.Inc()
+	defer public.HandshakeInFlight.Dec()
+
+	start := time.Now()
+	sess.err = sess.tls.Handshake()
+	sess.duration = time.Since(start)
+	sess.done.Store(true)
+	if err := conn.Wake(nil); err != nil {
+		public.Logger.Debug("wake after handshake failed", zap.Error(err))
+	}
+}
+
+// establish 在事件循环中处理握手结果, 成功后开始处理握手期间已经到达的数据
+func (s *server) establish(conn gnet.Conn, sess *session) gnet.Action {
+	if sess.expire != nil {
+		sess.expire.Stop()
+	}
+	if sess.err != nil {
+		sess.failed = true
+		public.ObserveHandshakeError(sess.err)
+		public.Logger.Info("handshake failed", zap.Stringer("remote", sess.ClientAddr), zap.Error(sess.err))
+		return gnet.Close
+	}
+	_ = sess.feed.SetReadDeadline(nonBlocking)
+	state := sess.tls.ConnectionState()
+	sess.Identity = public.TLSIdentity(state)
+	sess.Tenant, sess.Protocol = s.certs.Tenant(state.ServerName), state.NegotiatedProtocol
+	sess.TLS = public.NewTLSInfo(state)
+	public.ObserveHandshake(sess.duration, state, sess.Tenant)
+	sess.established = true
+	public.Logger.Debug("connection established", zap.Stringer("remote", sess.ClientAddr), zap.String("identity", sess.Identity),
+		zap.String("tenant", sess.Tenant), zap.String("protocol", sess.Protocol))
+	public.ConnectionCount.Inc()
+	public.TenantConnected(sess.Peer)
+	s.registry.Add(conn, sess.Peer)
+	return s.serve(conn, sess)
+}
+
+func (s *server) serve(conn gnet.Conn, sess *session) (action gnet.Action) {
+	if err := sess.decrypt(); err != nil {
+		if errors.Is(err, io.EOF) {
+			// 对端发送了 close_notify
+			sess.MarkClose(public.CloseEOF)
+		} else {
+			public.Logger.Info("decrypt failed", zap.Error(err))
+			sess.MarkClose(public.CloseProtocol)
+		}
+		return gnet.Close
+	}
+	// 一次可读事件中可能已经解密出多个帧(如 pong 与数据帧), 处理完所有完整的帧, 不完整的留到下次
+	for {
+		// 限速暂停期间解密出的数据留在 plain 中, 等 Wake 后再处理
+		if time.Now().Before(sess.ResumeAt) {
+			return
+		}
+		if len(sess.plain) < protocol.HeaderSize {
+			return
+		}
+		frameLen, err := protocol.FrameLen(sess.plain[:protocol.HeaderSize])
+		if err != nil {
+			public.Logger.Info("read failed", zap.Error(err))
+			sess.MarkClose(public.CloseProtocol)
+			return gnet.Close
+		}
+		if len(sess.plain) < frameLen {
+			return
+		}
+		frame := sess.plain[:frameLen]
+		sess.plain = sess.plain[frameLen:]
+		sess.FrameIn(frameLen)
+		drop, err := s.limiter.Limit(sess.Peer, frameLen)
+		if err != nil {
+			sess.MarkClose(public.CloseRateLimit)
+			return gnet.Close
+		}
+		if drop {
+			continue
+		}
+		if action = s.handleFrame(sess, frame); action != gnet.None {
+			return
+		}
+		if wait := time.Until(sess.ResumeAt); wait > 0 {
+			time.AfterFunc(wait, func() { _ = conn.Wake(nil) })
+			return
+		}
+	}
+}
+
+// decrypt 解密 feed 中所有完整的 tls 记录, 明文追加到 plain. 不完整的记录留在 tls.Conn 中等待更多数据
+func (sess *session) decrypt() error {
+	for {
+		if cap(sess.plain)-len(sess.plain) < 4096 {
+			sess.plain = append(make([]byte, 0, len(sess.plain)+16384), sess.plain...)
+		}
+		n, err := sess.tls.Read(sess.plain[len(sess.plain):cap(sess.plain)])
+		sess.plain = sess.plain[:len(sess.plain)+n]
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *server) handleFrame(sess *session, frame []byte) (action gnet.Action) {
+	defer public.RequestCount.Inc()
+	start := time.Now()
+	header, body, err := protocol.Read(bytes.NewReader(frame))
+	if err != nil {
+		public.Logger.Info("read failed", zap.Error(err))
+		sess.MarkClose(public.ClassifyClose(err))
+		return gnet.Close
+	}
+	ft, body, err := public.StartFrameTrace(header, body, start)
+	if err != nil {
+		public.Logger.Info("read trace context failed", zap.Error(err))
+		sess.MarkClose(public.CloseProtocol)
+		return gnet.Close
+	}
+	defer ft.End()
+	if reply, ok, err := public.HandleHeartbeat(header, body); ok {
+		if err != nil {
+			public.Logger.Info("heartbeat failed", zap.Error(err))
+			return gnet.Close
+		}
+		if reply != nil {
+			if err := sess.WriteFrame(sess.tls, reply); err != nil {
+				public.Logger.Info("write pong failed", zap.Error(err))
+				sess.MarkClose(public.CloseWriteError)
+				return gnet.Close
+			}
+		}
+		return
+	}
+	public.Logger.Debug("read", zap.String("identity", sess.Identity), zap.String("tenant", sess.Tenant), zap.ByteString("body", body))
+	reply, err := s.router.Serve(sess.Peer, body)
+	if err != nil {
+		public.Logger.Info("handle failed", zap.Error(err))
+		return gnet.Close
+	}
+	if reply == nil {
+		return
+	}
+	ft.Stage("write")
+	if bytes, err := protocol.Pack(reply); err != nil {
+		public.Logger.Info("pack failed", zap.Error(err))
+		return gnet.Close
+	} else {
+		if err := sess.WriteFrame(sess.tls, bytes); err != nil {
+			public.Logger.Info("write failed", zap.Error(err))
+			sess.MarkClose(public.CloseWriteError)
+			return gnet.Close
+		}
+	}
+	return
+}
+
+// OnClose err 为 gnet 读写 socket 的错误, 由 action 或 Close 关闭时为 nil, 此时原因来自 MarkClose
+func (s *server) OnClose(conn gnet.Conn, err error) (action gnet.Action) {
+	if conn.Context() == nil {
+		return
+	}
+	sess := conn.Context().(*session)
+	s.admission.Release()
+	sess.Loop.AddFds(-1)
+	// 还在握手的 worker 从 feed 读到错误后结束
+	sess.feed.Fail(net.ErrClosed)
+	if sess.expire != nil {
+		sess.expire.Stop()
+	}
+	switch {
+	case sess.established:
+		public.ConnectionCount.Dec()
+		public.ObserveClose(sess.Peer, err)
+		public.TenantDisconnected(sess.Peer)
+		s.registry.Remove(conn)
+	case sess.expired.Load():
+		public.ObserveHandshakeError(os.ErrDeadlineExceeded)
+	case sess.failed:
+	case sess.done.Load() && sess.err != nil:
+		// 握手失败后来不及回到事件循环
+		public.ObserveHandshakeError(sess.err)
+	default:
+		// 握手完成之前对端关闭
+		public.ObserveHandshakeError(io.EOF)
+	}
+	return
+}
+
+type server struct {
+	gnet.BuiltinEventEngine
+
+	ctx       context.Context
+	pool      *goroutine.Pool
+	admin     *public.Admin
+	config    *tls.Config
+	certs     *public.CertReloader
+	router    *public.Router
+	registry  *public.Registry[gnet.Conn]
+	limiter   *public.RateLimiter
+	admission *public.Admission
+}
+
+var _ gnet.EventHandler = (*server)(nil)
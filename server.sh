@@ -1,5 +1,6 @@
 SRC_FILE=$(realpath -m "${1:-s2_epoll}/server.go")
 go build -tags=static,netgo,poll_opt,gc_opt -o build/server "$SRC_FILE"
+[ -f certs/server.pem ] || go run ./gencert -out certs
 
 docker network rm 1m-tcpserver 2>/dev/null
 docker network create --subnet 10.89.3.0/24 1m-tcpserver
@@ -11,7 +12,8 @@ docker run -l 1m-server \
     --network 1m-tcpserver \
     --ip 10.89.3.10 \
     -v "$(pwd)/build/server:/server" \
+    -v "$(pwd)/certs:/certs:ro" \
     --name 1m-server \
     -p 8112:8112 \
     --rm \
-    alpine /server
+    alpine /server -admin-addr :8112